@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// CircuitBreaker answers forwarded requests with 503 once upstream.circuit_breaker.failures of them in a row have
+// failed, so consumers don't pile up behind an upstream outage. After cooldown seconds it lets a single request
+// through to test upstream, closing again if that one succeeds, or opening for another cooldown if it fails.
+type CircuitBreaker struct {
+	mutex     *sync.Mutex
+	failures  uint64
+	openUntil time.Time
+	probing   bool
+}
+
+func NewCircuitBreaker() *CircuitBreaker {
+	return &CircuitBreaker{
+		mutex: new(sync.Mutex),
+	}
+}
+
+// Allow returns 0 if the request may go to upstream, or how long until the breaker lets one through again.
+// If probing is true, the request is testing upstream and must be followed by Report or Abandon.
+func (b *CircuitBreaker) Allow(conf *ConfigBreaker) (wait time.Duration, probing bool) {
+	if conf.Failures == 0 {
+		return 0, false
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.failures < conf.Failures {
+		return 0, false
+	}
+	if wait := time.Until(b.openUntil); wait > 0 {
+		return wait, false
+	}
+	if b.probing {
+		// Another request is already testing upstream
+		return time.Second, false
+	}
+	b.probing = true
+	return 0, true
+}
+
+// Report records whether upstream failed a request, meaning it could not be reached or answered with a 5xx.
+func (b *CircuitBreaker) Report(conf *ConfigBreaker, failed bool) {
+	if conf.Failures == 0 {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !failed {
+		if b.failures >= conf.Failures {
+			slog.Info("Circuit breaker closed, upstream has recovered")
+		}
+		b.failures = 0
+		b.probing = false
+		return
+	}
+	b.failures++
+	if b.failures == conf.Failures || (b.failures > conf.Failures && b.probing) {
+		b.openUntil = time.Now().Add(time.Duration(conf.Cooldown) * time.Second)
+		slog.Warn("Circuit breaker opened, answering forwarded requests with 503", "failures", b.failures, "cooldown", time.Duration(conf.Cooldown)*time.Second)
+	}
+	b.probing = false
+}
+
+// Abandon lets another request test upstream after the one testing it ended without telling anything about upstream,
+// such as when the consumer went away. It does nothing after Report.
+func (b *CircuitBreaker) Abandon() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.probing = false
+}
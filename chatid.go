@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+
+	"github.com/tidwall/gjson"
+)
+
+// maxChatIDPeekSize bounds how much of a request body we buffer while looking for chat_id.
+const maxChatIDPeekSize = 64 << 10
+
+// peekedFields are the request fields we need before forwarding, as sent, or empty strings if missing.
+type peekedFields struct {
+	// chatID is either a number or an @username
+	chatID    string
+	messageID string
+	// inlineMessageID and replyMarkup are only found in bodies, and only if chat_id and message_id are missing
+	inlineMessageID string
+	replyMarkup     string
+}
+
+// setIfEmpty fills in a field unless the query string already did.
+func setIfEmpty(field *string, value string) {
+	if len(*field) == 0 {
+		*field = value
+	}
+}
+
+func (f *peekedFields) complete() bool {
+	return len(f.chatID) != 0 && len(f.messageID) != 0
+}
+
+// peekFields finds the chat_id and message_id of a request, or the inline_message_id and reply_markup of an inline edit,
+// without consuming its body.
+// It returns empty strings for fields missing or not found within maxChatIDPeekSize bytes,
+// along with a reader that yields the complete original body.
+//
+// Multipart bodies are parsed part by part while recording the bytes read so far.
+// Bot API clients usually send chat_id before the file parts, so we stop at the first file part
+// and never buffer the upload itself.
+func peekFields(r *http.Request) (peekedFields, io.Reader) {
+	query := r.URL.Query()
+	fields := peekedFields{
+		chatID:    query.Get("chat_id"),
+		messageID: query.Get("message_id"),
+	}
+	if fields.complete() {
+		return fields, r.Body
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		return fields, r.Body
+	}
+
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var recorded bytes.Buffer
+	limited := io.LimitReader(r.Body, maxChatIDPeekSize)
+	rest := func() io.Reader {
+		return io.MultiReader(&recorded, r.Body)
+	}
+
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		_, err := recorded.ReadFrom(limited)
+		if err != nil {
+			return fields, rest()
+		}
+		form, _ := url.ParseQuery(recorded.String())
+		setIfEmpty(&fields.chatID, form.Get("chat_id"))
+		setIfEmpty(&fields.messageID, form.Get("message_id"))
+		fields.inlineMessageID = form.Get("inline_message_id")
+		fields.replyMarkup = form.Get("reply_markup")
+		return fields, rest()
+	case "application/json":
+		_, err := recorded.ReadFrom(limited)
+		if err != nil {
+			return fields, rest()
+		}
+		setIfEmpty(&fields.chatID, gjson.GetBytes(recorded.Bytes(), "chat_id").String())
+		setIfEmpty(&fields.messageID, gjson.GetBytes(recorded.Bytes(), "message_id").String())
+		fields.inlineMessageID = gjson.GetBytes(recorded.Bytes(), "inline_message_id").String()
+		fields.replyMarkup = gjson.GetBytes(recorded.Bytes(), "reply_markup").Raw
+		return fields, rest()
+	case "multipart/form-data":
+		mr := multipart.NewReader(io.TeeReader(limited, &recorded), params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err != nil || len(part.FileName()) != 0 {
+				// Fall back to no rate limiting rather than buffering the upload
+				return fields, rest()
+			}
+			var field *string
+			var limit int64 = 64
+			switch part.FormName() {
+			case "chat_id":
+				field = &fields.chatID
+			case "message_id":
+				field = &fields.messageID
+			case "inline_message_id":
+				field = &fields.inlineMessageID
+			case "reply_markup":
+				field = &fields.replyMarkup
+				limit = maxChatIDPeekSize
+			default:
+				continue
+			}
+			value, err := io.ReadAll(io.LimitReader(part, limit))
+			if err != nil {
+				return fields, rest()
+			}
+			setIfEmpty(field, string(value))
+			if fields.complete() {
+				return fields, rest()
+			}
+		}
+	}
+	return fields, r.Body
+}
@@ -3,35 +3,81 @@ package main
 import (
 	"bytes"
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math/rand"
 	"net/http"
-	"runtime/debug"
+	"path"
+	"reflect"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tidwall/gjson"
 )
 
-const UserAgent = "Mozilla/5.0 Telegram-bot-muxer/1.0 (+https://github.com/m13253/telegram-bot-muxer)"
+// UserAgent is appended to upstream.user_agent in every request to upstream, and sent alone with deliveries to consumers.
+const UserAgent = "Telegram-bot-muxer/1.0 (+https://github.com/m13253/telegram-bot-muxer)"
+
+// savedOffsetMaxAge is how old a saved offset may be, shorter than the week after which upstream may renumber updates.
+const savedOffsetMaxAge = 6 * 24 * time.Hour
+
+// echoRequest carries what an echo processor needs to know about the request that produced the echo.
+type echoRequest struct {
+	method string
+	// chatID is 0 if the request had no chat_id or referred to an unknown @username
+	chatID int64
+	// messageID is 0 if the request had no message_id
+	messageID int64
+	// inlineMessageID and replyMarkup are empty unless the request edits an inline message
+	inlineMessageID string
+	replyMarkup     string
+	// deleteAfter is 0 unless the consumer asked us to delete the sent message later
+	deleteAfter time.Duration
+}
 
 type Client struct {
-	conf              *Config
+	conf              *atomic.Pointer[Config]
+	httpClient        *http.Client
 	db                *Database
+	fileCache         *FileCache
+	requestSlots      chan struct{}
+	downloadSlots     chan struct{}
+	recorder          *Recorder
+	readCache         *ReadCache
+	metrics           *Metrics
 	typesNeedCaching  map[string]struct{}
-	echoProcessor     map[string]func([]byte)
+	echoProcessor     map[string]func(body []byte, req *echoRequest)
 	nextRetryInterval time.Duration
+	retryAfter        time.Duration
+	pollingLimit      uint64
+	pollFailures      *atomic.Uint64
+	lastPoll          *atomic.Int64
 	cooldownMutex     *sync.RWMutex
+	globalInterval    time.Duration
 	globalCooldown    time.Time
 	chatCooldown      map[int64]time.Time
+	chatUsernames     map[string]int64
+	deleterWake       chan struct{}
+	getMeMutex        *sync.Mutex
+	rateLimitLog      *RateLimitLog
+	breaker           *CircuitBreaker
 }
 
-func NewClient(conf *Config, db *Database) *Client {
+func NewClient(conf *Config, db *Database, fileCache *FileCache) *Client {
 	c := &Client{
-		conf: conf,
-		db:   db,
+		conf:       new(atomic.Pointer[Config]),
+		httpClient: newHTTPClient(&conf.Upstream),
+		db:         db,
+		fileCache:  fileCache,
+		recorder:   NewRecorder(&conf.Recording),
+		readCache:  NewReadCache(conf.Upstream.ReadCache),
 		typesNeedCaching: map[string]struct{}{
 			"message":                 {},
 			"edited_message":          {},
@@ -41,11 +87,25 @@ func NewClient(conf *Config, db *Database) *Client {
 			"edited_business_message": {},
 		},
 		nextRetryInterval: time.Second,
+		pollingLimit:      conf.Upstream.PollingLimit,
+		pollFailures:      new(atomic.Uint64),
+		lastPoll:          new(atomic.Int64),
 		cooldownMutex:     new(sync.RWMutex),
+		globalInterval:    time.Duration(conf.Upstream.RateLimit.GlobalIntervalMs) * time.Millisecond,
 		globalCooldown:    time.Now(),
 		chatCooldown:      make(map[int64]time.Time),
+		chatUsernames:     make(map[string]int64),
+		deleterWake:       make(chan struct{}, 1),
+		requestSlots:      newSlots(conf.Upstream.Transport.MaxConcurrentRequests),
+		downloadSlots:     newSlots(conf.Upstream.Transport.MaxConcurrentDownloads),
+		getMeMutex:        new(sync.Mutex),
+		rateLimitLog:      NewRateLimitLog(conf.Upstream.RateLimitLog),
+		breaker:           NewCircuitBreaker(),
 	}
-	c.echoProcessor = map[string]func([]byte){
+	c.conf.Store(conf)
+	c.metrics = NewMetrics(c)
+	c.metrics.retryInterval.Set(c.nextRetryInterval.Seconds())
+	c.echoProcessor = map[string]func(body []byte, req *echoRequest){
 		"sendMessage":             c.processEchoMessage,
 		"forwardMessage":          c.processEchoMessage,
 		"copyMessage":             c.processEchoMessage,
@@ -69,59 +129,165 @@ func NewClient(conf *Config, db *Database) *Client {
 		"editMessageLiveLocation": c.processEchoMessageEdit,
 		"stopMessageLiveLocation": c.processEchoMessageEdit,
 		"editMessageReplyMarkup":  c.processEchoMessageEdit,
+		"deleteMessage":           c.processEchoMessageDelete,
+		// stopPoll returns a Poll instead of a Message, and upstream already delivers it as a "poll" update
+	}
+	for _, method := range slices.Concat(conf.Upstream.EchoMethods, conf.Upstream.NoEchoMethods) {
+		if _, ok := c.echoProcessor[method]; !ok {
+			slog.Warn("Unknown method in upstream.echo_methods or no_echo_methods, it is never echoed anyway", "method", method)
+		}
+	}
+	for method := range c.echoProcessor {
+		if (len(conf.Upstream.EchoMethods) != 0 && !slices.Contains(conf.Upstream.EchoMethods, method)) || slices.Contains(conf.Upstream.NoEchoMethods, method) {
+			delete(c.echoProcessor, method)
+		}
 	}
 	return c
 }
 
+// newHTTPClient creates the client for every upstream request.
+// It has no timeout of its own, since long polls take as long as they take, so other requests use requestContext.
+func newHTTPClient(conf *ConfigUpstream) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = int(conf.Transport.MaxIdleConnsPerHost)
+	transport.IdleConnTimeout = time.Duration(conf.Transport.IdleConnTimeout) * time.Second
+	if conf.ProxyURL != nil {
+		transport.Proxy = http.ProxyURL(conf.ProxyURL)
+	}
+	return &http.Client{Transport: transport}
+}
+
+// newSlots returns a semaphore of n slots, or nil for no limit.
+func newSlots(n uint64) chan struct{} {
+	if n == 0 {
+		return nil
+	}
+	return make(chan struct{}, n)
+}
+
+// acquireSlot waits for a free slot, and returns the function giving it back.
+func acquireSlot(ctx context.Context, slots chan struct{}) (func(), error) {
+	if slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// requestContext bounds a request other than polling by upstream.request_timeout.
+func (c *Client) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.config().Upstream.RequestTimeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(c.config().Upstream.RequestTimeout)*time.Second)
+}
+
+// config returns the current config, which Reload may replace at any time.
+func (c *Client) config() *Config {
+	return c.conf.Load()
+}
+
+// Reload applies the upstream section of a newly loaded config, which is read afresh by every poll and forward.
+// Everything else is fixed at startup, so changes to it are logged and ignored, and so are the upstream settings
+// that other parts already set up with, or that would point us at a different bot.
+func (c *Client) Reload(newConf *Config) {
+	oldConf := c.config()
+	conf := *oldConf
+	conf.Upstream = newConf.Upstream
+	ignore := func(name string, changed bool) {
+		if changed {
+			slog.Warn("Config reload: ignoring changes, restart to apply them", "section", name)
+		}
+	}
+	ignore("db", conf.DB != newConf.DB || conf.DBCompression != newConf.DBCompression)
+	ignore("database", conf.Database != newConf.Database)
+	ignore("retention", !reflect.DeepEqual(conf.Retention, newConf.Retention))
+	ignore("recording", !reflect.DeepEqual(conf.Recording, newConf.Recording))
+	ignore("shutdown", !reflect.DeepEqual(conf.Shutdown, newConf.Shutdown))
+	ignore("downstream", !reflect.DeepEqual(conf.Downstream, newConf.Downstream))
+	if oldConf.Upstream.AuthToken != newConf.Upstream.AuthToken {
+		ignore("upstream.auth_token", true)
+		conf.Upstream.AuthToken = oldConf.Upstream.AuthToken
+		conf.Upstream.ApiPrefix = oldConf.Upstream.ApiPrefix
+		conf.Upstream.FilePrefix = oldConf.Upstream.FilePrefix
+	}
+	if oldConf.Upstream.TestEnvironment != newConf.Upstream.TestEnvironment {
+		// The test environment has bots and update_ids of its own, so it is like switching to another token
+		ignore("upstream.test_environment", true)
+		conf.Upstream.TestEnvironment = oldConf.Upstream.TestEnvironment
+		conf.Upstream.ApiPrefix = oldConf.Upstream.ApiPrefix
+		conf.Upstream.FilePrefix = oldConf.Upstream.FilePrefix
+	}
+	ignore("upstream.file_cache", !reflect.DeepEqual(oldConf.Upstream.FileCache, newConf.Upstream.FileCache))
+	conf.Upstream.FileCache = oldConf.Upstream.FileCache
+	ignore("upstream.webhook", !reflect.DeepEqual(oldConf.Upstream.Webhook, newConf.Upstream.Webhook))
+	conf.Upstream.Webhook = oldConf.Upstream.Webhook
+	ignore("upstream.proxy", oldConf.Upstream.Proxy != newConf.Upstream.Proxy)
+	conf.Upstream.Proxy = oldConf.Upstream.Proxy
+	conf.Upstream.ProxyURL = oldConf.Upstream.ProxyURL
+	ignore("upstream.transport", !reflect.DeepEqual(oldConf.Upstream.Transport, newConf.Upstream.Transport))
+	conf.Upstream.Transport = oldConf.Upstream.Transport
+	ignore("upstream.read_cache", !reflect.DeepEqual(oldConf.Upstream.ReadCache, newConf.Upstream.ReadCache))
+	conf.Upstream.ReadCache = oldConf.Upstream.ReadCache
+	ignore("upstream.echo_methods", !slices.Equal(oldConf.Upstream.EchoMethods, newConf.Upstream.EchoMethods) || !slices.Equal(oldConf.Upstream.NoEchoMethods, newConf.Upstream.NoEchoMethods))
+	conf.Upstream.EchoMethods = oldConf.Upstream.EchoMethods
+	conf.Upstream.NoEchoMethods = oldConf.Upstream.NoEchoMethods
+	ignore("upstream.rate_limit_log", oldConf.Upstream.RateLimitLog != newConf.Upstream.RateLimitLog)
+	conf.Upstream.RateLimitLog = oldConf.Upstream.RateLimitLog
+	c.conf.Store(&conf)
+	slog.Info("Config reloaded")
+}
+
+func (c *Client) RebuildMessageCache(ctx context.Context) error {
+	updateTypes := make([]string, 0, len(c.typesNeedCaching))
+	for updateType := range c.typesNeedCaching {
+		updateTypes = append(updateTypes, updateType)
+	}
+	return c.db.RebuildMessageCache(ctx, updateTypes, func(done, total uint64) {
+		slog.Info("Rebuilding message cache", "done", done, "total", total)
+	})
+}
+
 func (c *Client) StartPolling(ctx context.Context) error {
-	offset := uint64(0)
+	offset, err := c.loadOffset(ctx)
+	if err != nil {
+		return err
+	}
 
 	for {
+		if ctx.Err() != nil {
+			// Updates fetched by an aborted poll are not confirmed yet, so upstream will deliver them again
+			if offset != 0 {
+				c.confirmOffset(offset)
+			}
+			return nil
+		}
+
 		var requestURL string
 		if offset == 0 {
-			requestURL = fmt.Sprintf(
-				"%s/getUpdates?timeout=%d&allowed_updates=%s",
-				c.conf.Upstream.ApiPrefix, c.conf.Upstream.PollingTimeout, c.conf.Upstream.FilterUpdateTypesStr,
-			)
+			requestURL = c.config().Upstream.ApiURL("getUpdates", fmt.Sprintf(
+				"limit=%d&timeout=%d&allowed_updates=%s",
+				min(c.pollingLimit, c.config().Upstream.PollingLimit), c.config().Upstream.PollingTimeout, c.config().Upstream.FilterUpdateTypesStr,
+			))
 		} else {
-			requestURL = fmt.Sprintf(
-				"%s/getUpdates?offset=%d&timeout=%d&allowed_updates=%s",
-				c.conf.Upstream.ApiPrefix, offset, c.conf.Upstream.PollingTimeout, c.conf.Upstream.FilterUpdateTypesStr,
-			)
+			requestURL = c.config().Upstream.ApiURL("getUpdates", fmt.Sprintf(
+				"offset=%d&limit=%d&timeout=%d&allowed_updates=%s",
+				offset, min(c.pollingLimit, c.config().Upstream.PollingLimit), c.config().Upstream.PollingTimeout, c.config().Upstream.FilterUpdateTypesStr,
+			))
 		}
-		log.Println("GET", requestURL)
+		slog.Debug("Polling upstream", "url", requestURL)
 
-		req, err := http.NewRequestWithContext(ctx, "GET", requestURL, nil)
+		body, retry, err := c.fetchUpdates(ctx, requestURL)
 		if err != nil {
-			return fmt.Errorf("failed to send HTTP request: %v", err)
-		}
-		req.Header.Set("User-Agent", UserAgent)
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			// Assume this is not a fatal error
-			log.Println("Upstream HTTP request error:", err)
-			c.sleepUntilRetry()
-			continue
-		}
-		defer resp.Body.Close()
-
-		requestSucceed := resp.StatusCode >= 200 && resp.StatusCode < 300
-		failureIsFatal := resp.StatusCode >= 400 && resp.StatusCode < 500
-		if !requestSucceed {
-			log.Println("Upstream server returned error:", resp.Status)
-		}
-		if failureIsFatal {
-			return fmt.Errorf("HTTP error: %s", resp.Status)
-		}
-		if !requestSucceed {
-			c.sleepUntilRetry()
-			continue
-		}
-
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			log.Println("HTTP read error:", err)
-			c.sleepUntilRetry()
+			if !retry {
+				return err
+			}
+			c.pollFailures.Add(1)
+			c.sleepUntilRetry(ctx)
 			continue
 		}
 
@@ -129,74 +295,352 @@ func (c *Client) StartPolling(ctx context.Context) error {
 		if bodyJson.Get("ok").Type != gjson.True {
 			errorCode := bodyJson.Get("error_code").String()
 			errorDesc := bodyJson.Get("description").String()
-			log.Println("Upstream error:", errorCode, errorDesc)
-			c.sleepUntilRetry()
+			slog.Warn("Upstream error", "method", "getUpdates", "error_code", errorCode, "description", errorDesc)
+			c.retryAfter = retryAfter(nil, body)
+			c.pollFailures.Add(1)
+			c.sleepUntilRetry(ctx)
 			continue
 		}
+		c.pollFailures.Store(0)
+		c.lastPoll.Store(time.Now().UnixNano())
 
+		storeStart := time.Now()
 		tx, err := c.db.BeginTx()
 		if err != nil {
-			log.Println("Failed to store updates:", err)
-			c.sleepUntilRetry()
+			slog.Error("Failed to store updates", "err", err)
+			c.sleepUntilRetry(ctx)
 			continue
 		}
+		// Only move past this batch once it is stored, so upstream delivers it again if storing fails
+		nextOffset := offset
 		bodyJson.Get("result").ForEach(func(_, update gjson.Result) bool {
-			upstreamID := update.Get("update_id").Uint()
-			offset = max(offset, upstreamID+1)
-			update.ForEach(func(updateType, updateValue gjson.Result) bool {
-				if updateType.Str == "update_id" {
-					return true
-				}
-				if _, ok := c.typesNeedCaching[updateType.Str]; ok {
-					err = tx.InsertMessage(&updateValue)
-					if err != nil {
-						return false
-					}
-				}
-				err = tx.InsertUpdate(upstreamID, updateType.String(), updateValue.Raw)
-				return err == nil
-			})
+			nextOffset = max(nextOffset, update.Get("update_id").Uint()+1)
+			err = c.storeUpdate(&tx, &update)
 			return err == nil
 		})
+		if err == nil && nextOffset != 0 {
+			err = tx.SaveOffset(nextOffset, c.botID())
+		}
 		if err != nil {
-			tx.Commit()
-			c.db.NotifyUpdates()
-			log.Println("Failed to store updates:", err)
-			c.sleepUntilRetry()
+			tx.Rollback()
+			slog.Error("Failed to store updates", "err", err)
+			c.sleepUntilRetry(ctx)
 			continue
 		}
 		err = tx.Commit()
 		c.db.NotifyUpdates()
 		if err != nil {
-			log.Println("Failed to store updates:", err)
-			c.sleepUntilRetry()
+			slog.Error("Failed to store updates", "err", err)
+			c.sleepUntilRetry(ctx)
 			continue
 		}
+		offset = nextOffset
 
 		c.resetRetry()
+		c.adjustPollingLimit(ctx, time.Since(storeStart))
 	}
 }
 
-func (c *Client) ForwardRequest(ctx context.Context, w http.ResponseWriter, r *http.Request, prefix string, suffix string, isFile bool) error {
+// adjustPollingLimit halves how many updates each poll asks for while storing a poll takes longer than
+// upstream.slow_store_ms, and pauses as long as storing took, so a struggling disk gets small transactions
+// and some room instead of ever larger backlogs. Each fast store doubles the limit again, up to polling_limit.
+func (c *Client) adjustPollingLimit(ctx context.Context, storeDuration time.Duration) {
+	c.metrics.storeDuration.Set(storeDuration.Seconds())
+	conf := &c.config().Upstream
+	if conf.SlowStoreMs == 0 || storeDuration <= time.Duration(conf.SlowStoreMs)*time.Millisecond {
+		c.pollingLimit = min(c.pollingLimit*2, conf.PollingLimit)
+		return
+	}
+	c.pollingLimit = max(min(c.pollingLimit, conf.PollingLimit)/2, 1)
+	slog.Warn("Storing updates is slow, polling fewer at a time", "duration", storeDuration.Round(time.Millisecond), "limit", c.pollingLimit)
+	select {
+	case <-ctx.Done():
+	case <-time.After(storeDuration):
+	}
+}
+
+// SinceLastPoll returns how long ago a poll last succeeded, or false if none has yet. lastPoll holds Unix nanoseconds.
+// With a webhook, it returns 0 once the webhook is set, since updates may legitimately not arrive for a long time.
+func (c *Client) SinceLastPoll() (time.Duration, bool) {
+	lastPoll := c.lastPoll.Load()
+	if lastPoll == 0 {
+		return 0, false
+	}
+	if len(c.config().Upstream.Webhook.URL) != 0 {
+		return 0, true
+	}
+	return time.Since(time.Unix(0, lastPoll)), true
+}
+
+// loadOffset returns the offset saved by the last poll, so a restart after a crash does not fetch everything
+// we stored already again. It is ignored if it belongs to another bot, or if it is older than a week,
+// after which upstream may number new updates from a random lower value.
+func (c *Client) loadOffset(ctx context.Context) (uint64, error) {
+	offset, botID, savedAt, err := c.db.LoadOffset(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load offset: %v", err)
+	}
+	if offset == 0 {
+		return 0, nil
+	}
+	if botID != c.botID() {
+		slog.Info("Ignoring saved offset, which belongs to another bot", "offset", offset)
+		return 0, nil
+	}
+	if time.Since(savedAt) > savedOffsetMaxAge {
+		slog.Info("Ignoring saved offset, which is too old", "offset", offset, "saved_at", savedAt)
+		return 0, nil
+	}
+	slog.Info("Resuming polling from saved offset", "offset", offset)
+	return offset, nil
+}
+
+// botID returns the numeric bot ID at the start of upstream.auth_token, or 0 if it has none.
+func (c *Client) botID() int64 {
+	id, _, _ := strings.Cut(c.config().Upstream.AuthToken, ":")
+	botID, _ := strconv.ParseInt(id, 10, 64)
+	return botID
+}
+
+// GetMe returns the result of getMe, from the database while it is younger than upstream.get_me_ttl, otherwise from upstream.
+// Consumers usually call it on every start, and since they all share our token, they all share one cached result.
+func (c *Client) GetMe(ctx context.Context) (string, error) {
+	c.getMeMutex.Lock()
+	defer c.getMeMutex.Unlock()
+	result, fetchedAt, err := c.db.CachedResult(ctx, "getMe")
+	if err != nil {
+		return "", err
+	}
+	// A result cached before auth_token changed belongs to another bot
+	ttl := time.Duration(c.config().Upstream.GetMeTTL) * time.Second
+	if len(result) != 0 && gjson.Get(result, "id").Int() == c.botID() && time.Since(fetchedAt) < ttl {
+		return result, nil
+	}
+	value, err := c.callMethod(ctx, "getMe", "")
+	if err != nil {
+		return "", err
+	}
+	err = c.db.PutCachedResult(ctx, "getMe", value.Raw)
+	if err != nil {
+		slog.Error("Failed to cache getMe", "err", err)
+	}
+	return value.Raw, nil
+}
+
+// storeUpdate stores an update received from upstream, by polling or by webhook.
+func (c *Client) storeUpdate(tx *DatabaseTx, update *gjson.Result) error {
+	upstreamID := update.Get("update_id").Uint()
+	// Upstream delivers updates again if we stopped before confirming them, and caching their messages again
+	// could overwrite a later edit with an older version
+	exists, err := tx.HasUpdate(upstreamID)
+	if err != nil {
+		return err
+	}
+	if exists {
+		slog.Info("Skipping update, which is stored already", "update_id", upstreamID)
+		return nil
+	}
+	update.ForEach(func(updateType, updateValue gjson.Result) bool {
+		if updateType.Str == "update_id" {
+			return true
+		}
+		if c.config().Upstream.MaxUpdateSize != 0 && uint64(len(updateValue.Raw)) > c.config().Upstream.MaxUpdateSize {
+			slog.Warn("Update is over upstream.max_update_size", "update_id", upstreamID, "type", updateType.Str, "size", len(updateValue.Raw))
+			if c.config().Upstream.OversizedUpdates == "skip" {
+				return true
+			}
+			// Keep the update_id sequence intact, so the consumer can tell something was left out
+			err = tx.InsertUpdate(upstreamID, OversizedUpdateType, fmt.Sprintf("{\"type\":%s,\"size\":%d}", JSONQuote(updateType.Str), len(updateValue.Raw)))
+			return err == nil
+		}
+		if _, ok := c.typesNeedCaching[updateType.Str]; ok {
+			err = tx.InsertMessage(&updateValue)
+			if err != nil {
+				return false
+			}
+		}
+		err = tx.InsertUpdate(upstreamID, updateType.String(), updateValue.Raw)
+		return err == nil
+	})
+	if err == nil {
+		c.metrics.updatesReceived.Inc()
+	}
+	return err
+}
+
+// confirmOffset tells upstream we have stored every update below offset, so they are not delivered again after a restart.
+func (c *Client) confirmOffset(offset uint64) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	requestURL := c.config().Upstream.ApiURL("getUpdates", fmt.Sprintf(
+		"offset=%d&limit=1&timeout=0&allowed_updates=%s",
+		offset, c.config().Upstream.FilterUpdateTypesStr,
+	))
+	slog.Debug("Confirming offset", "url", requestURL)
+	c.fetchUpdates(ctx, requestURL)
+}
+
+// fetchUpdates performs a single long poll. Non-fatal errors are logged here and reported with retry set.
+func (c *Client) fetchUpdates(ctx context.Context, requestURL string) ([]byte, bool, error) {
+	// A connection silently dropped by a NAT or a system suspend, or an upstream that never answers, would otherwise
+	// block us forever. The deadline covers reading the body too, after which the poll is retried like any other error.
+	pollCtx, cancelPoll := context.WithTimeout(ctx, time.Duration(c.config().Upstream.PollingTimeout+c.config().Upstream.PollingGrace)*time.Second)
+	defer cancelPoll()
+	go watchSuspend(pollCtx, cancelPoll)
+
+	req, err := http.NewRequestWithContext(pollCtx, "GET", requestURL, nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to send HTTP request: %v", err)
+	}
+	req.Header.Set("User-Agent", c.config().Upstream.UserAgentHeader())
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		// Assume this is not a fatal error
+		slog.Warn("Upstream HTTP request error", "method", "getUpdates", "err", err)
+		return nil, true, err
+	}
+	defer drainAndClose(resp.Body)
+
+	requestSucceed := resp.StatusCode >= 200 && resp.StatusCode < 300
+	failureIsFatal := resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests
+	if resp.StatusCode == http.StatusTooManyRequests {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+		c.retryAfter = retryAfter(resp.Header, body)
+	}
+	if !requestSucceed {
+		slog.Warn("Upstream server returned error", "method", "getUpdates", "status", resp.StatusCode)
+	}
+	if failureIsFatal {
+		return nil, false, fmt.Errorf("HTTP error: %s", resp.Status)
+	}
+	if !requestSucceed {
+		return nil, true, fmt.Errorf("HTTP error: %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		slog.Warn("HTTP read error", "method", "getUpdates", "err", err)
+		return nil, true, err
+	}
+	return body, true, nil
+}
+
+// watchSuspend cancels a long poll once it notices the system was suspended.
+// Go timers run on the monotonic clock, which stops during suspend on Linux, so a deadline set before
+// suspending fires late by however long the system slept. The wall clock keeps running, so comparing
+// the two tells us the connection has most likely been dropped while we were asleep.
+func watchSuspend(ctx context.Context, cancel context.CancelFunc) {
+	const interval = 5 * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		// Round(0) strips the monotonic reading, so Sub falls back to the wall clock
+		if now.Round(0).Sub(last.Round(0))-now.Sub(last) > interval {
+			slog.Warn("System suspend detected, reconnecting to upstream")
+			cancel()
+			return
+		}
+		last = now
+	}
+}
+
+func (c *Client) ForwardRequest(ctx context.Context, w http.ResponseWriter, r *http.Request, suffix string, isFile bool) error {
+	start := time.Now()
+	var chatRef string
+	var cooldown time.Duration
+	var upstreamStart time.Time
+	if c.config().Downstream.SlowRequestMs != 0 {
+		defer func() {
+			total := time.Since(start)
+			if upstreamStart.IsZero() || total < time.Duration(c.config().Downstream.SlowRequestMs)*time.Millisecond {
+				return
+			}
+			slog.Warn("Slow request", "method", suffix, "chat_id", chatRef, "duration", total.Round(time.Millisecond), "cooldown", cooldown.Round(time.Millisecond), "upstream", time.Since(upstreamStart).Round(time.Millisecond))
+		}()
+	}
+	if !isFile && !c.config().Downstream.MethodAllowed(suffix) {
+		writeError(w, c.config().Downstream.ErrorPrefix, http.StatusForbidden, "Forbidden: method "+suffix+" is not allowed", 0)
+		return nil
+	}
+	if isFile && c.fileCache != nil && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		served, err := c.serveCachedFile(ctx, w, r, suffix)
+		if served || err != nil {
+			return err
+		}
+	}
+
+	// Polling shares what it knows about upstream health, so sends don't each wait for their own timeout during an outage
+	if c.config().Upstream.FailFastAfter != 0 && c.pollFailures.Load() >= c.config().Upstream.FailFastAfter {
+		writeError(w, c.config().Downstream.ErrorPrefix, http.StatusServiceUnavailable, "Service Unavailable: upstream is unreachable", 0)
+		return nil
+	}
+	breakerConf := &c.config().Upstream.CircuitBreaker
+	if wait, probing := c.breaker.Allow(breakerConf); wait > 0 {
+		retryAfter := int64((wait + time.Second - 1) / time.Second)
+		writeError(w, c.config().Downstream.ErrorPrefix, http.StatusServiceUnavailable, fmt.Sprintf("Service Unavailable: upstream is failing, retry after %d", retryAfter), retryAfter)
+		return nil
+	} else if probing {
+		defer c.breaker.Abandon()
+	}
+
 	var requestURL string
-	if len(r.URL.RawQuery) == 0 {
-		requestURL = fmt.Sprintf("%s/%s", prefix, suffix)
+	if isFile {
+		requestURL = c.config().Upstream.FileURL(suffix, r.URL.RawQuery)
+	} else {
+		requestURL = c.config().Upstream.ApiURL(suffix, r.URL.RawQuery)
+	}
+	slog.Debug("Forwarding request", "http_method", r.Method, "url", requestURL)
+	if isFile {
+		c.metrics.forwardedRequests.WithLabelValues("(file)").Inc()
 	} else {
-		requestURL = fmt.Sprintf("%s/%s?%s", prefix, suffix, r.URL.RawQuery)
+		c.metrics.forwardedRequests.WithLabelValues(methodLabel(suffix)).Inc()
 	}
-	log.Println(r.Method, requestURL)
 
+	if !isFile && c.config().Downstream.MaxUploadBytes != 0 {
+		limit := int64(c.config().Downstream.MaxUploadBytes)
+		if r.ContentLength > limit {
+			writeError(w, c.config().Downstream.ErrorPrefix, http.StatusRequestEntityTooLarge, "Request Entity Too Large", 0)
+			return nil
+		}
+		// A chunked upload is only caught once it is partly sent, which aborts the request to upstream
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+	body := io.Reader(r.Body)
+	var chatID int64
+	var messageID int64
+	var fields peekedFields
+	cacheable := !isFile && c.readCache.Cacheable(suffix)
 	if !isFile {
-		chatID, _ := strconv.ParseInt(r.FormValue("chat_id"), 10, 64)
+		fields, body = peekFields(r)
+		chatRef = fields.chatID
+		messageID, _ = strconv.ParseInt(fields.messageID, 10, 64)
+		if cacheable {
+			if cached, ok := c.readCache.Get(suffix, chatRef); ok {
+				h := w.Header()
+				h.Set("Content-Type", "application/json")
+				h.Set("X-Content-Type-Options", "nosniff")
+				w.Write(cached)
+				return nil
+			}
+		}
+		chatID = c.resolveChatID(chatRef)
 		if chatID != 0 {
-			c.cooldownMutex.RLock()
-			cooldown := c.globalCooldown
-			if cd, ok := c.chatCooldown[chatID]; ok && cd.After(cooldown) {
-				cooldown = cd
+			sleep := c.cooldownRemaining(chatID)
+			if c.config().Upstream.MaxCooldownWaitMs != 0 && sleep > time.Duration(c.config().Upstream.MaxCooldownWaitMs)*time.Millisecond {
+				// The consumer is flooding this chat, push back instead of piling up waiting requests
+				retryAfter := int64((sleep + time.Second - 1) / time.Second)
+				writeError(w, c.config().Downstream.ErrorPrefix, http.StatusTooManyRequests, fmt.Sprintf("Too Many Requests: retry after %d", retryAfter), retryAfter)
+				return nil
 			}
-			c.cooldownMutex.RUnlock()
-			sleep := time.Until(cooldown)
 			if sleep > 0 {
+				cooldown = sleep
 				select {
 				case <-ctx.Done():
 					return context.Canceled
@@ -206,176 +650,567 @@ func (c *Client) ForwardRequest(ctx context.Context, w http.ResponseWriter, r *h
 		}
 	}
 
-	req, err := http.NewRequestWithContext(ctx, r.Method, requestURL, r.Body)
+	// A slot stays taken until the response is copied, since the connection is busy until then
+	slots := c.requestSlots
+	if isFile {
+		slots = c.downloadSlots
+	}
+	release, err := acquireSlot(ctx, slots)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// Bound only the upstream round trip, not the cooldown and slot waits before it
+	ctx, cancel := c.requestContext(ctx)
+	defer cancel()
+
+	var recording *Recording
+	if !isFile {
+		recording = c.recorder.Start(r, suffix)
+	}
+	if recording != nil {
+		body = io.TeeReader(body, &recording.requestBody)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, r.Method, requestURL, body)
 	if err != nil {
 		return fmt.Errorf("failed to send HTTP request: %v", err)
 	}
+	req.ContentLength = r.ContentLength
+	// Leaving out the consumer's Accept-Encoding lets the transport ask upstream for gzip on its own and decompress
+	// the response for us, so echo processing sees plain JSON, and compressHandler compresses it again for the consumer
 	for k, v := range r.Header {
-		if k != "Accept-Encoding" && k != "Content-Encoding" && k != "Connection" && k != "Host" && k != "Proxy-Connection" && k != "User-Agent" {
+		if !isHopByHopHeader(k) && k != "Accept-Encoding" && k != "Content-Encoding" && k != "Host" && k != "User-Agent" && k != "X-Muxer-Delete-After" {
 			req.Header[k] = v
 		}
 	}
-	req.Header.Set("User-Agent", UserAgent)
-	resp, err := http.DefaultClient.Do(req)
+	req.Header.Set("User-Agent", c.config().Upstream.UserAgentHeader())
+	upstreamStart = time.Now()
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, c.config().Downstream.ErrorPrefix, http.StatusRequestEntityTooLarge, "Request Entity Too Large", 0)
+			return nil
+		}
+		// Only blame upstream if the consumer is still waiting, which includes hitting upstream.request_timeout
+		if r.Context().Err() == nil {
+			c.breaker.Report(breakerConf, true)
+		}
 		return fmt.Errorf("upstream HTTP request error: %v", err)
 	}
-	defer resp.Body.Close()
+	defer drainAndClose(resp.Body)
+	c.breaker.Report(breakerConf, resp.StatusCode >= 500)
+	respBody := io.Reader(resp.Body)
+	if !isFile && resp.StatusCode == http.StatusTooManyRequests {
+		peeked, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+		respBody = io.MultiReader(bytes.NewReader(peeked), resp.Body)
+		wait := retryAfter(resp.Header, peeked)
+		c.onRateLimited(chatID, wait)
+		c.rateLimitLog.Add(suffix, chatRef, wait)
+	}
+	if recording != nil {
+		respBody = io.TeeReader(respBody, &recording.responseBody)
+		defer c.recorder.Save(recording, resp)
+	}
 
 	respHeader := w.Header()
 	for k, v := range resp.Header {
-		if k != "Accept-Encoding" && k != "Content-Encoding" && k != "Connection" && k != "Proxy-Connection" {
+		// Never copy Connection from upstream, otherwise an upstream "Connection: close" would tear down the downstream connection
+		if !isHopByHopHeader(k) && k != "Accept-Encoding" && k != "Content-Encoding" {
 			respHeader[k] = v
 		}
 	}
+	if !isFile && suffix == "getFile" && len(c.config().Downstream.PublicFileURL) != 0 && resp.StatusCode == http.StatusOK {
+		rewritten, err := c.rewriteFilePath(respBody)
+		if err != nil {
+			return err
+		}
+		respBody = bytes.NewReader(rewritten)
+		respHeader.Set("Content-Length", strconv.Itoa(len(rewritten)))
+	}
 	w.WriteHeader(resp.StatusCode)
 	// Too late to report error, so ignore errors from here
 
-	var echoProcessor func([]byte)
+	var echoProcessor func([]byte, *echoRequest)
 	if !isFile {
 		echoProcessor = c.echoProcessor[suffix]
 	}
-	if echoProcessor == nil || resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		_, err = io.Copy(w, resp.Body)
+	if (echoProcessor == nil && !cacheable) || resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var errorBody *cappedBuffer
+		if !isFile && (resp.StatusCode < 200 || resp.StatusCode >= 300) {
+			errorBody = &cappedBuffer{limit: maxErrorBodySize}
+			respBody = io.TeeReader(respBody, errorBody)
+		}
+		_, err = io.Copy(w, respBody)
 		if err != nil {
-			debug.PrintStack()
-			log.Println("HTTP error:", err)
+			printStackIfDebug(ctx)
+			slog.Warn("HTTP error", "method", suffix, "err", err)
+		}
+		if errorBody != nil {
+			c.logUpstreamError(suffix, chatRef, resp.StatusCode, errorBody.buf.Bytes())
 		}
 		return nil
 	}
 
 	var bodyCopy bytes.Buffer
-	_, err = io.Copy(w, io.TeeReader(resp.Body, &bodyCopy))
+	_, err = io.Copy(w, io.TeeReader(respBody, &bodyCopy))
 	if err != nil {
-		debug.PrintStack()
-		log.Println("HTTP error:", err)
+		printStackIfDebug(ctx)
+		slog.Warn("HTTP error", "method", suffix, "err", err)
 		return nil
 	}
 
-	echoProcessor(bodyCopy.Bytes())
+	deleteAfter, _ := strconv.ParseUint(r.Header.Get("X-Muxer-Delete-After"), 10, 64)
+	if cacheable && gjson.GetBytes(bodyCopy.Bytes(), "ok").Type == gjson.True {
+		c.readCache.Put(suffix, chatRef, bodyCopy.Bytes())
+	}
+	if echoProcessor == nil {
+		return nil
+	}
+	c.metrics.echoMessages.Inc()
+	echoProcessor(bodyCopy.Bytes(), &echoRequest{
+		method:          suffix,
+		chatID:          chatID,
+		messageID:       messageID,
+		inlineMessageID: fields.inlineMessageID,
+		replyMarkup:     fields.replyMarkup,
+		deleteAfter:     time.Duration(deleteAfter) * time.Second,
+	})
 	return nil
 }
 
-func (c *Client) sleepUntilRetry() {
-	time.Sleep(c.nextRetryInterval)
-	c.nextRetryInterval = min(c.nextRetryInterval*2, time.Duration(c.conf.Upstream.MaxRetryInterval)*time.Second)
+// rewriteFilePath turns the file_path returned by getFile into a URL to download it through us,
+// for bots that would otherwise build a download URL pointing at upstream with their own token.
+func (c *Client) rewriteFilePath(body io.Reader) ([]byte, error) {
+	buf, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP read error: %v", err)
+	}
+	filePath := gjson.GetBytes(buf, "result.file_path")
+	if filePath.Type != gjson.String || filePath.Index == 0 {
+		return buf, nil
+	}
+	rewritten := make([]byte, 0, len(buf)+len(c.config().Downstream.PublicFileURL))
+	rewritten = append(rewritten, buf[:filePath.Index]...)
+	rewritten = append(rewritten, JSONQuote(c.config().Downstream.PublicFileURL+filePath.Str)...)
+	rewritten = append(rewritten, buf[filePath.Index+len(filePath.Raw):]...)
+	return rewritten, nil
+}
+
+// maxErrorBodySize bounds how much of an upstream error response we keep for the error log.
+// Telegram's error responses are tiny, anything larger is not one of them.
+const maxErrorBodySize = 4 << 10
+
+// logUpstreamError logs a failed forward, and with upstream.log_errors also records it in the database, so operators
+// can see every consumer's failures in one place. Only the method, chat_id, and Telegram's error are kept, never the request body.
+// The consumer still gets upstream's response as it was.
+func (c *Client) logUpstreamError(method string, chatRef string, statusCode int, body []byte) {
+	errorCode := int64(statusCode)
+	description := http.StatusText(statusCode)
+	bodyJson := gjson.ParseBytes(body)
+	if code := bodyJson.Get("error_code"); code.Type == gjson.Number {
+		errorCode = code.Int()
+	}
+	if desc := bodyJson.Get("description"); desc.Type == gjson.String {
+		description = desc.String()
+	}
+	slog.Warn("Upstream error", "method", method, "chat_id", chatRef, "error_code", errorCode, "description", description)
+	if !c.config().Upstream.LogErrors {
+		return
+	}
+	err := c.db.InsertUpstreamError(method, chatRef, errorCode, description)
+	if err != nil {
+		slog.Error("Failed to log upstream error", "method", method, "err", err)
+	}
+}
+
+// serveCachedFile returns false if the file cannot be cached and should be forwarded instead.
+func (c *Client) serveCachedFile(ctx context.Context, w http.ResponseWriter, r *http.Request, filePath string) (bool, error) {
+	f, err := c.fileCache.Open(ctx, filePath, func(dst io.Writer) error {
+		requestURL := c.config().Upstream.FileURL(filePath, "")
+		slog.Debug("Downloading file", "url", requestURL)
+		// Consumers waiting on the same download start their own if this one goes away
+		release, err := acquireSlot(ctx, c.downloadSlots)
+		if err != nil {
+			return err
+		}
+		defer release()
+		ctx, cancel := c.requestContext(ctx)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+		if err != nil {
+			return fmt.Errorf("failed to send HTTP request: %v", err)
+		}
+		req.Header.Set("User-Agent", c.config().Upstream.UserAgentHeader())
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("upstream HTTP request error: %v", err)
+		}
+		defer drainAndClose(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			// Let ForwardRequest relay the upstream error
+			return errFileNotCacheable
+		}
+		_, err = io.Copy(dst, resp.Body)
+		if err != nil {
+			return fmt.Errorf("upstream HTTP read error: %v", err)
+		}
+		return nil
+	})
+	if err == errFileNotCacheable {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false, fmt.Errorf("file cache error: %v", err)
+	}
+	http.ServeContent(w, r, path.Base(filePath), info.ModTime(), f)
+	return true, nil
+}
+
+func (c *Client) sleepUntilRetry(ctx context.Context) {
+	maxInterval := time.Duration(c.config().Upstream.MaxRetryInterval) * time.Second
+	// Spread the retries of instances that failed together, so they don't all hit upstream at the same moment
+	wait := min(time.Duration(float64(c.nextRetryInterval)*(0.8+0.4*rand.Float64())), maxInterval)
+	if c.retryAfter > wait {
+		wait = min(c.retryAfter, maxInterval)
+	}
+	c.retryAfter = 0
+	select {
+	case <-ctx.Done():
+	case <-time.After(wait):
+	}
+	c.nextRetryInterval = min(c.nextRetryInterval*2, maxInterval)
+	c.metrics.retryInterval.Set(c.nextRetryInterval.Seconds())
 }
 
 func (c *Client) resetRetry() {
 	c.nextRetryInterval = time.Second
+	c.metrics.retryInterval.Set(c.nextRetryInterval.Seconds())
 }
 
-func (c *Client) processEchoMessage(body []byte) {
+func (c *Client) processEchoMessage(body []byte, req *echoRequest) {
 	bodyJson := gjson.ParseBytes(body)
 	if bodyJson.Get("ok").Type != gjson.True {
 		errorCode := bodyJson.Get("error_code").String()
 		errorDesc := bodyJson.Get("description").String()
-		log.Println("Upstream error:", errorCode, errorDesc)
+		slog.Warn("Upstream error", "method", req.method, "chat_id", req.chatID, "error_code", errorCode, "description", errorDesc)
 		return
 	}
 
 	message := bodyJson.Get("result")
+	if !isMessage(&message) {
+		return
+	}
+	c.verifyEchoChatID(&message, req.chatID)
 	c.updateRateLimit(&message)
 	tx, err := c.db.BeginTx()
 	if err != nil {
-		log.Println("Failed to store updates:", err)
+		slog.Error("Failed to store updates", "method", req.method, "chat_id", req.chatID, "err", err)
+		return
 	}
 	err = tx.InsertMessage(&message)
 	if err != nil {
-		log.Println("Failed to store updates:", err)
+		slog.Error("Failed to store updates", "method", req.method, "chat_id", req.chatID, "err", err)
 	}
-	err = tx.InsertLocalUpdate("message", message.Raw)
+	err = tx.InsertLocalUpdate(echoUpdateType(&message, "message"), message.Raw)
 	if err != nil {
-		log.Println("Failed to store updates:", err)
+		slog.Error("Failed to store updates", "method", req.method, "chat_id", req.chatID, "err", err)
+	}
+	if req.deleteAfter != 0 {
+		err = tx.InsertDeletion(&message, time.Now().Add(req.deleteAfter))
+		if err != nil {
+			slog.Error("Failed to schedule deletion", "method", req.method, "chat_id", req.chatID, "err", err)
+		}
 	}
 	err = tx.Commit()
 	if err != nil {
-		log.Println("Failed to store updates:", err)
+		slog.Error("Failed to store updates", "method", req.method, "chat_id", req.chatID, "err", err)
 	}
 	c.db.NotifyUpdates()
+	if req.deleteAfter != 0 {
+		c.wakeDeleter()
+	}
+}
+
+// processEchoMessageDelete marks a message deleted through us as such in the message cache.
+// Messages deleted by anyone else stay as they are, since bots are not told about those.
+func (c *Client) processEchoMessageDelete(body []byte, req *echoRequest) {
+	bodyJson := gjson.ParseBytes(body)
+	if bodyJson.Get("ok").Type != gjson.True {
+		errorCode := bodyJson.Get("error_code").String()
+		errorDesc := bodyJson.Get("description").String()
+		slog.Warn("Upstream error", "method", req.method, "chat_id", req.chatID, "error_code", errorCode, "description", errorDesc)
+		return
+	}
+	if req.chatID == 0 || req.messageID == 0 {
+		return
+	}
+	err := c.db.MarkMessageDeleted(req.chatID, req.messageID, sql.NullString{})
+	if err != nil {
+		slog.Error("Failed to store updates", "method", req.method, "chat_id", req.chatID, "err", err)
+	}
 }
 
-func (c *Client) processEchoMessageEdit(body []byte) {
+func (c *Client) processEchoMessageEdit(body []byte, req *echoRequest) {
 	bodyJson := gjson.ParseBytes(body)
 	if bodyJson.Get("ok").Type != gjson.True {
 		errorCode := bodyJson.Get("error_code").String()
 		errorDesc := bodyJson.Get("description").String()
-		log.Println("Upstream error:", errorCode, errorDesc)
+		slog.Warn("Upstream error", "method", req.method, "chat_id", req.chatID, "error_code", errorCode, "description", errorDesc)
 		return
 	}
 
 	message := bodyJson.Get("result")
-	if message.Type == gjson.True {
+	// Edits of inline messages return true instead of a Message, so all we know is what the request asked for
+	if !isMessage(&message) {
+		if message.Type == gjson.True && len(req.inlineMessageID) != 0 {
+			err := c.db.InsertInlineEdit(req.inlineMessageID, req.method, req.replyMarkup)
+			if err != nil {
+				slog.Error("Failed to store updates", "method", req.method, "inline_message_id", req.inlineMessageID, "err", err)
+			}
+		}
 		return
 	}
+	c.verifyEchoChatID(&message, req.chatID)
 	tx, err := c.db.BeginTx()
 	if err != nil {
-		log.Println("Failed to store updates:", err)
+		slog.Error("Failed to store updates", "method", req.method, "chat_id", req.chatID, "err", err)
+		return
 	}
 	err = tx.InsertMessage(&message)
 	if err != nil {
-		log.Println("Failed to store updates:", err)
+		slog.Error("Failed to store updates", "method", req.method, "chat_id", req.chatID, "err", err)
 	}
-	err = tx.InsertLocalUpdate("edited_message", message.Raw)
+	err = tx.InsertLocalUpdate(echoUpdateType(&message, "edited_message"), message.Raw)
 	if err != nil {
-		log.Println("Failed to store updates:", err)
+		slog.Error("Failed to store updates", "method", req.method, "chat_id", req.chatID, "err", err)
 	}
 	err = tx.Commit()
 	if err != nil {
-		log.Println("Failed to store updates:", err)
+		slog.Error("Failed to store updates", "method", req.method, "chat_id", req.chatID, "err", err)
 	}
 	c.db.NotifyUpdates()
 }
 
-func (c *Client) processEchoMessageArray(body []byte) {
+func (c *Client) processEchoMessageArray(body []byte, req *echoRequest) {
 	bodyJson := gjson.ParseBytes(body)
 	if bodyJson.Get("ok").Type != gjson.True {
 		errorCode := bodyJson.Get("error_code").String()
 		errorDesc := bodyJson.Get("description").String()
-		log.Println("Upstream error:", errorCode, errorDesc)
+		slog.Warn("Upstream error", "method", req.method, "chat_id", req.chatID, "error_code", errorCode, "description", errorDesc)
+		return
+	}
+	// gjson makes the best of truncated JSON, which would store whatever messages it got to as if they were complete
+	result := bodyJson.Get("result")
+	if !gjson.ValidBytes(body) || !result.IsArray() {
+		slog.Warn("Ignoring malformed result", "method", req.method, "chat_id", req.chatID)
 		return
 	}
 
 	tx, err := c.db.BeginTx()
 	if err != nil {
-		log.Println("Failed to store updates:", err)
+		slog.Error("Failed to store updates", "method", req.method, "chat_id", req.chatID, "err", err)
+		return
 	}
-	bodyJson.Get("result").ForEach(func(_, message gjson.Result) bool {
-		c.updateRateLimit(&message)
+	// Each message is stored as an update of its own carrying the media_group_id, the same way upstream delivers albums
+	rateLimited := false
+	result.ForEach(func(key, message gjson.Result) bool {
+		if !isMessage(&message) {
+			slog.Warn("Skipping malformed message in result", "method", req.method, "chat_id", req.chatID, "index", key.Int())
+			return true
+		}
+		c.verifyEchoChatID(&message, req.chatID)
+		// One request, so one step of the adaptive spacing, and every message lands in the same chat anyway
+		if !rateLimited {
+			c.updateRateLimit(&message)
+			rateLimited = true
+		}
 		err := tx.InsertMessage(&message)
 		if err != nil {
-			log.Println("Failed to store updates:", err)
+			slog.Error("Failed to store updates", "method", req.method, "chat_id", req.chatID, "err", err)
 		}
-		err = tx.InsertLocalUpdate("message", message.Raw)
+		err = tx.InsertLocalUpdate(echoUpdateType(&message, "message"), message.Raw)
 		if err != nil {
-			log.Println("Failed to store updates:", err)
+			slog.Error("Failed to store updates", "method", req.method, "chat_id", req.chatID, "err", err)
+		}
+		if req.deleteAfter != 0 {
+			err = tx.InsertDeletion(&message, time.Now().Add(req.deleteAfter))
+			if err != nil {
+				slog.Error("Failed to schedule deletion", "method", req.method, "chat_id", req.chatID, "err", err)
+			}
 		}
 		return true
 	})
 	err = tx.Commit()
 	if err != nil {
-		log.Println("Failed to store updates:", err)
+		slog.Error("Failed to store updates", "method", req.method, "chat_id", req.chatID, "err", err)
 	}
 	c.db.NotifyUpdates()
+	if req.deleteAfter != 0 {
+		c.wakeDeleter()
+	}
+}
+
+// verifyEchoChatID warns if upstream placed a message in a different chat than the request asked for,
+// which would mean we are rate limiting or caching it under the wrong chat.
+// chatID is 0 if the request had none, or referred to the chat by username.
+func (c *Client) verifyEchoChatID(message *gjson.Result, chatID int64) {
+	if !c.config().Upstream.VerifyEchoChatID || chatID == 0 {
+		return
+	}
+	if echoChatID := message.Get("chat.id").Int(); echoChatID != chatID {
+		slog.Warn("Upstream returned a message in a different chat than requested", "chat_id", chatID, "echo_chat_id", echoChatID)
+	}
+}
+
+// cooldownRemaining returns how long a send to chatID has to wait.
+func (c *Client) cooldownRemaining(chatID int64) time.Duration {
+	c.cooldownMutex.RLock()
+	cooldown := c.globalCooldown
+	if cd, ok := c.chatCooldown[chatID]; ok && cd.After(cooldown) {
+		cooldown = cd
+	}
+	c.cooldownMutex.RUnlock()
+	return time.Until(cooldown)
+}
+
+// resolveChatID turns a chat_id parameter into a numeric chat ID, or 0 if unknown.
+// Usernames are only known after we have seen a message in that chat, so the first send to an
+// @username is only subject to the global cooldown.
+func (c *Client) resolveChatID(chatRef string) int64 {
+	if username, ok := strings.CutPrefix(chatRef, "@"); ok {
+		c.cooldownMutex.RLock()
+		chatID := c.chatUsernames[strings.ToLower(username)]
+		c.cooldownMutex.RUnlock()
+		return chatID
+	}
+	chatID, _ := strconv.ParseInt(chatRef, 10, 64)
+	return chatID
+}
+
+// echoUpdateType picks the update type for an echoed message, so a consumer seeing only business
+// updates also sees what was sent through a business connection.
+func echoUpdateType(message *gjson.Result, updateType string) string {
+	if !message.Get("business_connection_id").Exists() {
+		return updateType
+	}
+	switch updateType {
+	case "message":
+		return "business_message"
+	case "edited_message":
+		return "edited_business_message"
+	}
+	return updateType
+}
+
+func isMessage(result *gjson.Result) bool {
+	return result.IsObject() && result.Get("message_id").Exists() && result.Get("chat.id").Exists()
 }
 
 func (c *Client) updateRateLimit(message *gjson.Result) {
 	// https://core.telegram.org/bots/faq#my-bot-is-hitting-limits-how-do-i-avoid-this
 
+	// Cooldowns carry a monotonic reading, so a suspend stretches them by the time spent asleep.
+	// They are at most a few seconds long, so this only delays the first send after resuming.
 	now := time.Now()
 	c.cooldownMutex.Lock()
-	c.globalCooldown = now.Add(time.Second/30 + 1)
+	if c.config().Upstream.AdaptiveRateLimit.Enabled {
+		// Additive decrease of the spacing on every successful send
+		step := time.Duration(c.config().Upstream.AdaptiveRateLimit.DecreaseStepMs) * time.Millisecond
+		c.globalInterval = max(c.globalInterval-step, time.Duration(c.config().Upstream.AdaptiveRateLimit.MinIntervalMs)*time.Millisecond)
+	} else {
+		c.globalInterval = time.Duration(c.config().Upstream.RateLimit.GlobalIntervalMs) * time.Millisecond
+	}
+	c.globalCooldown = now.Add(c.globalInterval)
 
 	chatID := message.Get("chat.id").Int()
-	if chatID == 0 {
+	// Messages sent through a business connection come from the business account, not from the bot,
+	// so they don't count against the bot's own chat with the same user
+	if chatID == 0 || message.Get("business_connection_id").Exists() {
 		c.cooldownMutex.Unlock()
 		return
 	}
+	// Remember public usernames, so sends addressed by @username share the cooldown of the numeric ID.
+	// A renamed chat keeps its old entry too, which is harmless since usernames are unique at any moment.
+	if username := message.Get("chat.username").String(); len(username) != 0 {
+		c.chatUsernames[strings.ToLower(username)] = chatID
+	}
 	chatType := message.Get("chat.type").String()
 	if chatType == "private" {
-		c.chatCooldown[chatID] = now.Add(time.Second)
+		c.chatCooldown[chatID] = now.Add(time.Duration(c.config().Upstream.RateLimit.PrivateChatIntervalMs) * time.Millisecond)
 	} else {
-		c.chatCooldown[chatID] = now.Add(3 * time.Second)
+		c.chatCooldown[chatID] = now.Add(time.Duration(c.config().Upstream.RateLimit.GroupChatIntervalMs) * time.Millisecond)
+	}
+	c.cooldownMutex.Unlock()
+}
+
+// cooldownSweepBatch bounds how many stale cooldowns are deleted per write lock, so sends are never held up for long.
+const cooldownSweepBatch = 1000
+
+// StartSweeping periodically forgets chats whose cooldown ended long ago, which would otherwise pile up forever.
+func (c *Client) StartSweeping(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(c.config().Upstream.CooldownSweep.Interval) * time.Second):
+		}
+		c.sweepCooldowns(time.Now().Add(-time.Duration(c.config().Upstream.CooldownSweep.After) * time.Second))
+	}
+}
+
+func (c *Client) sweepCooldowns(cutoff time.Time) {
+	// Only look for stale chats under the read lock, which lets sends keep checking their cooldown meanwhile
+	var stale []int64
+	c.cooldownMutex.RLock()
+	for chatID, cooldown := range c.chatCooldown {
+		if cooldown.Before(cutoff) {
+			stale = append(stale, chatID)
+		}
+	}
+	c.cooldownMutex.RUnlock()
+
+	for len(stale) != 0 {
+		batch := stale[:min(len(stale), cooldownSweepBatch)]
+		stale = stale[len(batch):]
+		c.cooldownMutex.Lock()
+		for _, chatID := range batch {
+			// A send may have renewed the cooldown since we looked
+			if c.chatCooldown[chatID].Before(cutoff) {
+				delete(c.chatCooldown, chatID)
+			}
+		}
+		c.cooldownMutex.Unlock()
+	}
+}
+
+// onRateLimited is called when upstream answers 429 Too Many Requests.
+// Upstream's retry_after is honored for the chat it was sent to, or for every chat if that is unknown.
+func (c *Client) onRateLimited(chatID int64, retryAfter time.Duration) {
+	now := time.Now()
+	c.cooldownMutex.Lock()
+	if retryAfter > 0 {
+		until := now.Add(min(retryAfter, time.Duration(c.config().Upstream.MaxRetryInterval)*time.Second))
+		if chatID == 0 {
+			c.globalCooldown = until
+		} else if until.After(c.chatCooldown[chatID]) {
+			c.chatCooldown[chatID] = until
+		}
+	}
+	if !c.config().Upstream.AdaptiveRateLimit.Enabled {
+		c.cooldownMutex.Unlock()
+		return
 	}
+	// Multiplicative increase of the spacing, so we back off quickly once we overshoot
+	c.globalInterval = min(c.globalInterval*2, time.Duration(c.config().Upstream.AdaptiveRateLimit.MaxIntervalMs)*time.Millisecond)
+	c.globalCooldown = now.Add(c.globalInterval)
+	slog.Warn("Upstream rate limit hit, increasing global send interval", "chat_id", chatID, "interval", c.globalInterval)
 	c.cooldownMutex.Unlock()
 }
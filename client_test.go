@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// testMessage is a Message sent to the private chat 5, as upstream would return it.
+func testMessage(messageID int) string {
+	return fmt.Sprintf(`{"message_id":%d,"from":{"id":1,"is_bot":true,"first_name":"Bot"},"chat":{"id":5,"type":"private","first_name":"User"},"date":1700000000,"text":"hello"}`, messageID)
+}
+
+// countUpdates returns how many updates the default consumer has not seen yet.
+func countUpdates(t *testing.T, db *Database) uint64 {
+	t.Helper()
+	count, err := db.CountUpdates(context.Background(), "default", 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestProcessEchoMessageArray(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []int64
+	}{
+		{
+			name: "complete",
+			body: `{"ok":true,"result":[` + testMessage(1) + `,` + testMessage(2) + `]}`,
+			want: []int64{1, 2},
+		},
+		{
+			name: "truncated",
+			body: `{"ok":true,"result":[` + testMessage(1) + `,` + testMessage(2)[:40],
+		},
+		{
+			name: "malformed entries",
+			body: `{"ok":true,"result":[` + testMessage(1) + `,true,{"message_id":2},{"chat":{"id":5}},` + testMessage(3) + `]}`,
+			want: []int64{1, 3},
+		},
+		{
+			name: "not an array",
+			body: `{"ok":true,"result":` + testMessage(1) + `}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testClient(t, testConfig(t, ""))
+			c.processEchoMessageArray([]byte(tt.body), &echoRequest{method: "sendMediaGroup", chatID: 5})
+
+			if count := countUpdates(t, c.db); count != uint64(len(tt.want)) {
+				t.Errorf("stored %d updates, want %d", count, len(tt.want))
+			}
+			for messageID := range int64(4) {
+				message, _, _, err := c.db.GetMessage(context.Background(), 5, messageID, sql.NullString{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if cached, want := message != "", slices.Contains(tt.want, messageID); cached != want {
+					t.Errorf("message %d cached = %v, want %v", messageID, cached, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPollingStalledUpstream(t *testing.T) {
+	// Accepts each poll, then never answers
+	polls := make(chan time.Time, 16)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		polls <- time.Now()
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+
+	conf := testConfig(t, upstream.URL, "upstream.polling_grace = 1")
+	// Below what Load accepts, so the poll is abandoned after polling_grace alone
+	conf.Upstream.PollingTimeout = 0
+	c := testClient(t, conf)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- c.StartPolling(ctx)
+	}()
+
+	var first time.Time
+	for i := range 2 {
+		select {
+		case polled := <-polls:
+			if i == 0 {
+				first = polled
+			} else if waited := polled.Sub(first); waited < time.Second {
+				t.Errorf("poll retried after %v, before polling_grace ran out", waited)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("upstream got %d polls, want 2", i)
+		}
+	}
+	if failures := c.pollFailures.Load(); failures == 0 {
+		t.Error("abandoned poll was not counted as a failure")
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("StartPolling returned %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("StartPolling did not return after being canceled")
+	}
+}
+
+func TestEchoSkipsNonMessages(t *testing.T) {
+	poll := `{"id":"1","question":"?","options":[{"text":"yes","voter_count":1}],"total_voter_count":1,"is_closed":true,"is_anonymous":true,"type":"regular","allows_multiple_answers":false}`
+	tests := []struct {
+		name            string
+		method          string
+		result          string
+		inlineMessageID string
+		wantStored      bool
+		wantInlineEdit  bool
+	}{
+		{name: "send message", method: "sendMessage", result: testMessage(1), wantStored: true},
+		{name: "send true", method: "sendMessage", result: `true`},
+		{name: "send poll", method: "sendMessage", result: poll},
+		{name: "edit message", method: "editMessageText", result: testMessage(1), wantStored: true},
+		{name: "edit true", method: "editMessageText", result: `true`},
+		{name: "edit inline true", method: "editMessageText", result: `true`, inlineMessageID: "abc", wantInlineEdit: true},
+		{name: "edit poll", method: "editMessageReplyMarkup", result: poll},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testClient(t, testConfig(t, ""))
+			body := `{"ok":true,"result":` + tt.result + `}`
+			c.echoProcessor[tt.method]([]byte(body), &echoRequest{method: tt.method, chatID: 5, messageID: 1, inlineMessageID: tt.inlineMessageID})
+
+			if stored := countUpdates(t, c.db) != 0; stored != tt.wantStored {
+				t.Errorf("update stored = %v, want %v", stored, tt.wantStored)
+			}
+			message, _, _, err := c.db.GetMessage(context.Background(), 5, 1, sql.NullString{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cached := message != ""; cached != tt.wantStored {
+				t.Errorf("message cached = %v, want %v", cached, tt.wantStored)
+			}
+			edit, err := c.db.GetInlineEdit(context.Background(), "abc")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored := edit != ""; stored != tt.wantInlineEdit {
+				t.Errorf("inline edit stored = %v, want %v", stored, tt.wantInlineEdit)
+			}
+		})
+	}
+}
+
+// testBusinessMessage is testMessage sent on behalf of a business account.
+func testBusinessMessage(messageID int) string {
+	return `{"business_connection_id":"bc",` + testMessage(messageID)[1:]
+}
+
+func TestEchoUpdateType(t *testing.T) {
+	tests := []struct {
+		message    string
+		updateType string
+		want       string
+	}{
+		{testMessage(1), "message", "message"},
+		{testMessage(1), "edited_message", "edited_message"},
+		{testBusinessMessage(1), "message", "business_message"},
+		{testBusinessMessage(1), "edited_message", "edited_business_message"},
+	}
+	for _, tt := range tests {
+		message := gjson.Parse(tt.message)
+		if got := echoUpdateType(&message, tt.updateType); got != tt.want {
+			t.Errorf("echoUpdateType(%s, %q) = %q, want %q", tt.message, tt.updateType, got, tt.want)
+		}
+	}
+}
+
+func TestBusinessOnlyUpdates(t *testing.T) {
+	conf := testConfig(t, "", `upstream.filter_update_types = ["business"]`)
+	if !slices.Equal(conf.Upstream.FilterUpdateTypes, BusinessUpdateTypes) {
+		t.Errorf("filter_update_types = %v, want %v", conf.Upstream.FilterUpdateTypes, BusinessUpdateTypes)
+	}
+	c := testClient(t, conf)
+	ctx := context.Background()
+
+	tx, err := c.db.BeginTx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	update := gjson.Parse(`{"update_id":10,"business_message":` + testBusinessMessage(1) + `}`)
+	err = c.storeUpdate(&tx, &update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.processEchoMessage([]byte(`{"ok":true,"result":`+testBusinessMessage(2)+`}`), &echoRequest{method: "sendMessage", chatID: 5})
+	c.processEchoMessageEdit([]byte(`{"ok":true,"result":`+testBusinessMessage(2)+`}`), &echoRequest{method: "editMessageText", chatID: 5, messageID: 2})
+	c.processEchoMessage([]byte(`{"ok":true,"result":`+testMessage(3)+`}`), &echoRequest{method: "sendMessage", chatID: 5})
+
+	var types []string
+	for updateJSON, err := range c.db.GetUpdates(ctx, "default", 1, 100, BusinessUpdateTypes) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		gjson.Parse(updateJSON).ForEach(func(key, _ gjson.Result) bool {
+			if key.Str != "update_id" {
+				types = append(types, key.Str)
+			}
+			return true
+		})
+	}
+	want := []string{"business_message", "business_message", "edited_business_message"}
+	if !slices.Equal(types, want) {
+		t.Errorf("business-only consumer got %v, want %v", types, want)
+	}
+
+	// Message 3 was not sent through the business connection
+	for _, messageID := range []int64{1, 2, 3} {
+		message, _, _, err := c.db.GetMessage(ctx, 5, messageID, sql.NullString{String: "bc", Valid: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cached, want := message != "", messageID != 3; cached != want {
+			t.Errorf("business message %d cached = %v, want %v", messageID, cached, want)
+		}
+	}
+}
+
+func TestPollingStoreFailure(t *testing.T) {
+	var c *Client
+	var polls atomic.Int32
+	offsets := make(chan string, 16)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		offsets <- r.FormValue("offset")
+		switch polls.Add(1) {
+		case 1:
+		case 2:
+			// Storing works again when upstream delivers the batch a second time
+			_, err := c.db.conn.Exec("DROP TRIGGER fail_update;")
+			if err != nil {
+				t.Error(err)
+			}
+		default:
+			// Hold the long poll, but answer the one confirming the offset when polling stops
+			if r.FormValue("timeout") != "0" {
+				<-r.Context().Done()
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"ok":true,"result":[]}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"ok":true,"result":[{"update_id":10,"message":`+testMessage(1)+`},{"update_id":11,"message":`+testMessage(2)+`}]}`)
+	}))
+	defer upstream.Close()
+
+	c = testClient(t, testConfig(t, upstream.URL))
+	_, err := c.db.conn.Exec("CREATE TRIGGER fail_update BEFORE INSERT ON updates WHEN NEW.upstream_id = 11 BEGIN SELECT RAISE(FAIL, 'injected'); END;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- c.StartPolling(ctx)
+	}()
+
+	var got []string
+	for range 3 {
+		select {
+		case offset := <-offsets:
+			got = append(got, offset)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("upstream got polls with offsets %q, want 3 polls", got)
+		}
+	}
+	cancel()
+	<-done
+
+	// The failed batch is asked for again, and nothing of it was kept
+	if want := []string{"", "", "12"}; !slices.Equal(got, want) {
+		t.Errorf("upstream got polls with offsets %q, want %q", got, want)
+	}
+	if count := countUpdates(t, c.db); count != 2 {
+		t.Errorf("stored %d updates, want 2", count)
+	}
+}
@@ -3,84 +3,496 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"log/slog"
+	"net/netip"
 	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/BurntSushi/toml"
 )
 
 type Config struct {
-	DB         string           `toml:"db"`
-	Upstream   ConfigUpstream   `toml:"upstream"`
-	Downstream ConfigDownstream `toml:"downstream"`
+	Include       []string         `toml:"include"`
+	DB            string           `toml:"db"`
+	DBCompression string           `toml:"db_compression"`
+	Database      ConfigDatabase   `toml:"database"`
+	Retention     ConfigRetention  `toml:"retention"`
+	Recording     ConfigRecording  `toml:"recording"`
+	Shutdown      ConfigShutdown   `toml:"shutdown"`
+	Upstream      ConfigUpstream   `toml:"upstream"`
+	Downstream    ConfigDownstream `toml:"downstream"`
+}
+
+// ConfigDatabase holds the PRAGMAs applied to every SQLite connection when it is opened.
+type ConfigDatabase struct {
+	JournalMode         string `toml:"journal_mode"`
+	Synchronous         string `toml:"synchronous"`
+	BusyTimeoutMs       uint64 `toml:"busy_timeout_ms"`
+	MaintenanceInterval uint64 `toml:"maintenance_interval"`
+	StatsInterval       uint64 `toml:"stats_interval"`
+}
+
+type ConfigShutdown struct {
+	Order        string `toml:"order"`
+	DrainTimeout uint64 `toml:"drain_timeout"`
+}
+
+type ConfigRecording struct {
+	Dir         string   `toml:"dir"`
+	Methods     []string `toml:"methods"`
+	MaxBodySize uint64   `toml:"max_body_size"`
+	MaxFiles    uint64   `toml:"max_files"`
+}
+
+type ConfigRetention struct {
+	MaxAge          uint64            `toml:"max_age"`
+	PruneInterval   uint64            `toml:"prune_interval"`
+	Types           map[string]uint64 `toml:"types"`
+	Errors          uint64            `toml:"errors"`
+	CompactEdits    uint64            `toml:"compact_edits"`
+	KeepUndelivered bool              `toml:"keep_undelivered"`
 }
 
 type ConfigUpstream struct {
-	ApiUrl               string   `toml:"api_url"`
-	FileUrl              string   `toml:"file_url"`
-	AuthToken            string   `toml:"auth_token"`
-	PollingTimeout       uint64   `toml:"polling_timeout"`
-	MaxRetryInterval     uint64   `toml:"max_retry_interval"`
-	FilterUpdateTypes    []string `toml:"filter_update_types"`
-	ApiPrefix            string   `toml:"-"`
-	FilePrefix           string   `toml:"-"`
-	FilterUpdateTypesStr string   `toml:"-"`
+	ApiUrl               string              `toml:"api_url"`
+	FileUrl              string              `toml:"file_url"`
+	AuthToken            string              `toml:"auth_token"`
+	TestEnvironment      bool                `toml:"test_environment"`
+	PollingTimeout       uint64              `toml:"polling_timeout"`
+	PollingGrace         uint64              `toml:"polling_grace"`
+	PollingLimit         uint64              `toml:"polling_limit"`
+	SlowStoreMs          uint64              `toml:"slow_store_ms"`
+	MaxRetryInterval     uint64              `toml:"max_retry_interval"`
+	FilterUpdateTypes    []string            `toml:"filter_update_types"`
+	VerifyEchoChatID     bool                `toml:"verify_echo_chat_id"`
+	EchoMethods          []string            `toml:"echo_methods"`
+	NoEchoMethods        []string            `toml:"no_echo_methods"`
+	MaxCooldownWaitMs    uint64              `toml:"max_cooldown_wait_ms"`
+	FailFastAfter        uint64              `toml:"fail_fast_after"`
+	CircuitBreaker       ConfigBreaker       `toml:"circuit_breaker"`
+	LogErrors            bool                `toml:"log_errors"`
+	MaxUpdateSize        uint64              `toml:"max_update_size"`
+	OversizedUpdates     string              `toml:"oversized_updates"`
+	ApiTemplate          string              `toml:"api_template"`
+	FileTemplate         string              `toml:"file_template"`
+	FileCache            ConfigFileCache     `toml:"file_cache"`
+	Webhook              ConfigWebhook       `toml:"webhook"`
+	ReadCache            map[string]uint64   `toml:"read_cache"`
+	GetMeTTL             uint64              `toml:"get_me_ttl"`
+	RateLimitLog         uint64              `toml:"rate_limit_log"`
+	UserAgent            string              `toml:"user_agent"`
+	RateLimit            ConfigRateLimit     `toml:"rate_limit"`
+	RequestTimeout       uint64              `toml:"request_timeout"`
+	Proxy                string              `toml:"proxy"`
+	ProxyURL             *url.URL            `toml:"-"`
+	Transport            ConfigTransport     `toml:"transport"`
+	CooldownSweep        ConfigCooldownSweep `toml:"cooldown_sweep"`
+	AdaptiveRateLimit    ConfigAdaptive      `toml:"adaptive_rate_limit"`
+	ApiPrefix            string              `toml:"-"`
+	FilePrefix           string              `toml:"-"`
+	FilterUpdateTypesStr string              `toml:"-"`
+}
+
+type ConfigTransport struct {
+	MaxIdleConnsPerHost    uint64 `toml:"max_idle_conns_per_host"`
+	IdleConnTimeout        uint64 `toml:"idle_conn_timeout"`
+	MaxConcurrentRequests  uint64 `toml:"max_concurrent_requests"`
+	MaxConcurrentDownloads uint64 `toml:"max_concurrent_downloads"`
+}
+
+type ConfigRateLimit struct {
+	GlobalIntervalMs      uint64 `toml:"global_interval_ms"`
+	PrivateChatIntervalMs uint64 `toml:"private_chat_interval_ms"`
+	GroupChatIntervalMs   uint64 `toml:"group_chat_interval_ms"`
+}
+
+type ConfigBreaker struct {
+	Failures uint64 `toml:"failures"`
+	Cooldown uint64 `toml:"cooldown"`
+}
+
+type ConfigCooldownSweep struct {
+	Interval uint64 `toml:"interval"`
+	After    uint64 `toml:"after"`
+}
+
+// ConfigAdaptive tunes the AIMD controller for the spacing between any two sends.
+// Each successful send shrinks the spacing by DecreaseStepMs, down to MinIntervalMs.
+// Each 429 response doubles it, up to MaxIntervalMs.
+type ConfigAdaptive struct {
+	Enabled        bool   `toml:"enabled"`
+	MinIntervalMs  uint64 `toml:"min_interval_ms"`
+	MaxIntervalMs  uint64 `toml:"max_interval_ms"`
+	DecreaseStepMs uint64 `toml:"decrease_step_ms"`
+}
+
+type ConfigWebhook struct {
+	URL         string `toml:"url"`
+	ListenAddr  string `toml:"listen_addr"`
+	Path        string `toml:"path"`
+	SecretToken string `toml:"secret_token"`
+	MaxBodySize uint64 `toml:"max_body_size"`
+}
+
+type ConfigFileCache struct {
+	Dir     string `toml:"dir"`
+	MaxSize uint64 `toml:"max_size"`
 }
 
 type ConfigDownstream struct {
-	ListenAddr string   `toml:"listen_addr"`
-	ApiPath    string   `toml:"api_path"`
-	FilePath   string   `toml:"file_path"`
-	AuthToken  string   `toml:"auth_token"`
-	ApiPrefix  []string `toml:"-"`
-	FilePrefix []string `toml:"-"`
+	ListenAddr        string         `toml:"listen_addr"`
+	ApiPath           string         `toml:"api_path"`
+	FilePath          string         `toml:"file_path"`
+	AuthToken         string         `toml:"auth_token"`
+	KeepAlive         bool           `toml:"keep_alive"`
+	IdleTimeout       uint64         `toml:"idle_timeout"`
+	ReadHeaderTimeout uint64         `toml:"read_header_timeout"`
+	MaxLongPolls      uint64         `toml:"max_long_polls"`
+	MaxPollTimeout    uint64         `toml:"max_poll_timeout"`
+	CoalesceWindowMs  uint64         `toml:"coalesce_window_ms"`
+	CompressThreshold uint64         `toml:"compress_threshold"`
+	RequireAck        bool           `toml:"require_ack"`
+	ErrorPrefix       string         `toml:"error_prefix"`
+	SlowRequestMs     uint64         `toml:"slow_request_ms"`
+	MaxResponseBytes  uint64         `toml:"max_response_bytes"`
+	MaxUploadBytes    uint64         `toml:"max_upload_bytes"`
+	MetricsPath       string         `toml:"metrics_path"`
+	HealthPath        string         `toml:"health_path"`
+	HealthStaleAfter  uint64         `toml:"health_stale_after"`
+	TLSCert           string         `toml:"tls_cert"`
+	TLSKey            string         `toml:"tls_key"`
+	PublicFileURL     string         `toml:"public_file_url"`
+	SocketMode        uint32         `toml:"socket_mode"`
+	AllowedCIDRs      []string       `toml:"allowed_cidrs"`
+	AllowedMethods    []string       `toml:"allowed_methods"`
+	BlockedMethods    []string       `toml:"blocked_methods"`
+	RateLimit         float64        `toml:"rate_limit"`
+	RateLimitBurst    uint64         `toml:"rate_limit_burst"`
+	WebhookTimeout    uint64         `toml:"webhook_timeout"`
+	LogLevel          string         `toml:"log_level"`
+	LogFormat         string         `toml:"log_format"`
+	LogLevelValue     slog.Level     `toml:"-"`
+	AllowedPrefixes   []netip.Prefix `toml:"-"`
+	ApiPrefix         []string       `toml:"-"`
+	FilePrefix        []string       `toml:"-"`
 }
 
-func Load(path string) (*Config, error) {
-	file, err := os.Open(path)
+// OversizedUpdateType is the type of the placeholder stored in place of an update over upstream.max_update_size.
+const OversizedUpdateType = "tbmux_oversized_update"
+
+// KnownUpdateTypes lists the fields of Update as of Bot API 8.3, append to it when Telegram adds new ones.
+var KnownUpdateTypes = []string{
+	"message",
+	"edited_message",
+	"channel_post",
+	"edited_channel_post",
+	"business_connection",
+	"business_message",
+	"edited_business_message",
+	"deleted_business_messages",
+	"message_reaction",
+	"message_reaction_count",
+	"inline_query",
+	"chosen_inline_result",
+	"callback_query",
+	"shipping_query",
+	"pre_checkout_query",
+	"purchased_paid_media",
+	"poll",
+	"poll_answer",
+	"my_chat_member",
+	"chat_member",
+	"chat_join_request",
+	"chat_boost",
+	"removed_chat_boost",
+}
+
+var BusinessUpdateTypes = []string{
+	"business_connection",
+	"business_message",
+	"edited_business_message",
+	"deleted_business_messages",
+}
+
+// parseUpstreamURL checks that api_url or file_url is an absolute http:// or https:// URL,
+// without a query or fragment, which would end up in front of the token and method.
+func parseUpstreamURL(field string, raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load config file: %v", err)
+		return nil, fmt.Errorf("invalid config file: %s is invalid: %v", field, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid config file: %s must be an http:// or https:// URL", field)
+	}
+	if len(u.Host) == 0 {
+		return nil, fmt.Errorf("invalid config file: %s has no host", field)
 	}
-	d := toml.NewDecoder(file)
+	if len(u.RawQuery) != 0 || len(u.Fragment) != 0 || u.ForceQuery {
+		return nil, fmt.Errorf("invalid config file: %s must not have a query or fragment", field)
+	}
+	return u, nil
+}
+
+// checkExpandedURL checks the URL produced by a template. If the template starts with the base URL,
+// the token must be appended to its path, not to its host as happens when the base URL has no path.
+func checkExpandedURL(field string, expanded string, template string, placeholder string, base *url.URL) error {
+	u, err := url.ParseRequestURI(expanded)
+	// Without a path, the token ends up in the host, where it either fails to parse as a port or names another host
+	if strings.HasPrefix(template, placeholder) && (err != nil && len(base.Path) == 0 || err == nil && u.Host != base.Host) {
+		return fmt.Errorf("invalid config file: %s appends the token to the host of %s, which needs a path such as /bot", field, placeholder)
+	}
+	// The parse error would quote the URL, token and all, so leave it out
+	if err != nil {
+		return fmt.Errorf("invalid config file: %s does not produce a valid URL", field)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid config file: %s must produce an http:// or https:// URL", field)
+	}
+	if len(u.Host) == 0 {
+		return fmt.Errorf("invalid config file: %s produces a URL without a host", field)
+	}
+	return nil
+}
+
+// Load reads the config from path, or from every *.conf file in it if path is a directory.
+//
+// Files are decoded one after another into the same Config, followed by the files listed in their include.
+// A later file replaces scalars and arrays set by an earlier one, and merges into tables key by key.
+func Load(path string) (*Config, error) {
 	conf := &Config{
 		DB: "tbmux.db",
+		Recording: ConfigRecording{
+			Methods:     []string{},
+			MaxBodySize: 1 << 20,
+			MaxFiles:    1000,
+		},
+		Database: ConfigDatabase{
+			JournalMode:         "wal",
+			Synchronous:         "normal",
+			BusyTimeoutMs:       5000,
+			MaintenanceInterval: 3600,
+			StatsInterval:       60,
+		},
+		Shutdown: ConfigShutdown{
+			Order:        "poll_first",
+			DrainTimeout: 30,
+		},
+		Retention: ConfigRetention{
+			PruneInterval: 3600,
+			Types:         map[string]uint64{},
+			Errors:        604800,
+		},
 		Upstream: ConfigUpstream{
 			ApiUrl:            "https://api.telegram.org/bot",
 			FileUrl:           "https://api.telegram.org/file/bot",
 			PollingTimeout:    60,
+			PollingGrace:      15,
+			PollingLimit:      100,
+			SlowStoreMs:       1000,
 			MaxRetryInterval:  600,
 			FilterUpdateTypes: []string{},
+			MaxUpdateSize:     16 << 20,
+			OversizedUpdates:  "placeholder",
+			ApiTemplate:       "{api_url}{token}/{method}",
+			FileTemplate:      "{file_url}{token}/{file_path}",
+			ReadCache:         map[string]uint64{},
+			GetMeTTL:          3600,
+			RateLimitLog:      1000,
+			UserAgent:         "Mozilla/5.0",
+			Webhook: ConfigWebhook{
+				Path:        "/webhook",
+				MaxBodySize: 16 << 20,
+			},
+			RateLimit: ConfigRateLimit{
+				GlobalIntervalMs:      34,
+				PrivateChatIntervalMs: 1000,
+				GroupChatIntervalMs:   3000,
+			},
+			RequestTimeout: 300,
+			Transport: ConfigTransport{
+				MaxIdleConnsPerHost: 16,
+				IdleConnTimeout:     90,
+			},
+			CircuitBreaker: ConfigBreaker{
+				Cooldown: 30,
+			},
+			CooldownSweep: ConfigCooldownSweep{
+				Interval: 600,
+				After:    600,
+			},
+			AdaptiveRateLimit: ConfigAdaptive{
+				MinIntervalMs:  10,
+				MaxIntervalMs:  5000,
+				DecreaseStepMs: 1,
+			},
 		},
 		Downstream: ConfigDownstream{
-			ApiPath:  "/bot",
-			FilePath: "/file/bot",
+			ApiPath:           "/bot",
+			FilePath:          "/file/bot",
+			KeepAlive:         true,
+			IdleTimeout:       120,
+			ReadHeaderTimeout: 10,
+			SocketMode:        0o660,
+			MaxLongPolls:      16,
+			CompressThreshold: 4096,
+			ErrorPrefix:       "[tbmux] ",
+			HealthStaleAfter:  180,
+			RateLimitBurst:    20,
+			WebhookTimeout:    60,
+			LogLevel:          "info",
+			LogFormat:         "text",
 		},
 	}
-	_, err = d.Decode(conf)
+	paths, err := configFilesIn(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load config file: %v", err)
 	}
+	for _, path := range paths {
+		err = decodeConfigFile(conf, path, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Secrets may come from the environment instead of the file
+	for _, secret := range []struct {
+		field string
+		value *string
+	}{
+		{"upstream.auth_token", &conf.Upstream.AuthToken},
+		{"upstream.proxy", &conf.Upstream.Proxy},
+		{"upstream.webhook.secret_token", &conf.Upstream.Webhook.SecretToken},
+		{"downstream.auth_token", &conf.Downstream.AuthToken},
+	} {
+		*secret.value, err = expandEnv(secret.field, *secret.value)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	// Check for errors
 	if len(conf.DB) == 0 {
 		return nil, &errConfigFieldIsEmpty{field: "db"}
 	}
+	// SQLite would otherwise create a file named after the URL
+	if strings.HasPrefix(conf.DB, "postgres://") || strings.HasPrefix(conf.DB, "postgresql://") {
+		return nil, fmt.Errorf("invalid config file: db must be the path of an SQLite database, PostgreSQL is not supported")
+	}
+	conf.DB, err = expandPath(conf.DB)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file: db cannot be expanded: %v", err)
+	}
+	switch conf.DBCompression {
+	case "", "none", "gzip":
+	default:
+		return nil, fmt.Errorf("invalid config file: db_compression must be \"none\" or \"gzip\"")
+	}
+	switch strings.ToLower(conf.Database.JournalMode) {
+	case "delete", "truncate", "persist", "memory", "wal", "off":
+	default:
+		return nil, fmt.Errorf("invalid config file: database.journal_mode must be \"delete\", \"truncate\", \"persist\", \"memory\", \"wal\", or \"off\"")
+	}
+	if conf.Database.MaintenanceInterval != 0 && conf.Database.MaintenanceInterval < 60 {
+		return nil, &errConfigDurationIsTooShort{field: "database.maintenance_interval"}
+	}
+	if conf.Database.StatsInterval != 0 && conf.Database.StatsInterval < 10 {
+		return nil, &errConfigDurationIsTooShort{field: "database.stats_interval"}
+	}
+	switch strings.ToLower(conf.Database.Synchronous) {
+	case "off", "normal", "full", "extra":
+	default:
+		return nil, fmt.Errorf("invalid config file: database.synchronous must be \"off\", \"normal\", \"full\", or \"extra\"")
+	}
+	if conf.Shutdown.Order != "poll_first" && conf.Shutdown.Order != "forwards_first" {
+		return nil, fmt.Errorf("invalid config file: shutdown.order must be \"poll_first\" or \"forwards_first\"")
+	}
+	if conf.Retention.PruneInterval < 60 {
+		return nil, &errConfigDurationIsTooShort{field: "retention.prune_interval"}
+	}
+	// A misspelled type would never match any update, and silently keep them for max_age instead
+	for updateType := range conf.Retention.Types {
+		if !slices.Contains(KnownUpdateTypes, updateType) && updateType != OversizedUpdateType {
+			return nil, fmt.Errorf("invalid config file: retention.types has unknown update type %s", updateType)
+		}
+	}
 	if len(conf.Upstream.ApiUrl) == 0 {
 		return nil, &errConfigFieldIsEmpty{field: "upstream.api_url"}
 	}
 	if len(conf.Upstream.FileUrl) == 0 {
 		return nil, &errConfigFieldIsEmpty{field: "upstream.file_url"}
 	}
+	apiURL, err := parseUpstreamURL("upstream.api_url", conf.Upstream.ApiUrl)
+	if err != nil {
+		return nil, err
+	}
+	fileURL, err := parseUpstreamURL("upstream.file_url", conf.Upstream.FileUrl)
+	if err != nil {
+		return nil, err
+	}
 	if len(conf.Upstream.AuthToken) == 0 {
 		return nil, &errConfigFieldIsEmpty{field: "upstream.auth_token"}
 	}
 	if conf.Upstream.PollingTimeout < 10 {
 		return nil, &errConfigDurationIsTooShort{field: "upstream.polling_timeout"}
 	}
+	if conf.Upstream.PollingGrace == 0 {
+		return nil, &errConfigDurationIsTooShort{field: "upstream.polling_grace"}
+	}
+	if len(conf.Upstream.Proxy) != 0 {
+		conf.Upstream.ProxyURL, err = url.Parse(conf.Upstream.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config file: upstream.proxy is invalid: %v", err)
+		}
+		switch conf.Upstream.ProxyURL.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("invalid config file: upstream.proxy must be an http://, https://, socks5:// or socks5h:// URL")
+		}
+		if len(conf.Upstream.ProxyURL.Host) == 0 {
+			return nil, fmt.Errorf("invalid config file: upstream.proxy has no host")
+		}
+	}
+	if conf.Upstream.PollingLimit < 1 || conf.Upstream.PollingLimit > 100 {
+		return nil, fmt.Errorf("invalid config file: upstream.polling_limit must be between 1 and 100")
+	}
 	if conf.Upstream.MaxRetryInterval < 60 {
 		return nil, &errConfigDurationIsTooShort{field: "upstream.max_retry_interval"}
 	}
+	if conf.Upstream.CircuitBreaker.Failures != 0 && conf.Upstream.CircuitBreaker.Cooldown == 0 {
+		return nil, &errConfigDurationIsTooShort{field: "upstream.circuit_breaker.cooldown"}
+	}
+	if conf.Upstream.CooldownSweep.Interval < 10 {
+		return nil, &errConfigDurationIsTooShort{field: "upstream.cooldown_sweep.interval"}
+	}
+	if conf.Upstream.AdaptiveRateLimit.Enabled {
+		if conf.Upstream.AdaptiveRateLimit.MinIntervalMs == 0 {
+			return nil, &errConfigDurationIsTooShort{field: "upstream.adaptive_rate_limit.min_interval_ms"}
+		}
+		if conf.Upstream.AdaptiveRateLimit.MaxIntervalMs < conf.Upstream.AdaptiveRateLimit.MinIntervalMs {
+			return nil, &errConfigDurationIsTooShort{field: "upstream.adaptive_rate_limit.max_interval_ms"}
+		}
+	}
+	if conf.Upstream.OversizedUpdates != "placeholder" && conf.Upstream.OversizedUpdates != "skip" {
+		return nil, fmt.Errorf("invalid config file: upstream.oversized_updates must be \"placeholder\" or \"skip\"")
+	}
+	// Go refuses to send such a header, which would fail every request instead of failing here
+	if strings.ContainsFunc(conf.Upstream.UserAgent, func(c rune) bool { return c < ' ' || c == 0x7f }) {
+		return nil, fmt.Errorf("invalid config file: upstream.user_agent must not contain control characters")
+	}
+	if len(conf.Upstream.FileCache.Dir) != 0 && conf.Upstream.FileCache.MaxSize == 0 {
+		return nil, &errConfigFieldIsEmpty{field: "upstream.file_cache.max_size"}
+	}
+	if len(conf.Upstream.Webhook.URL) != 0 {
+		if len(conf.Upstream.Webhook.ListenAddr) == 0 {
+			return nil, &errConfigFieldIsEmpty{field: "upstream.webhook.listen_addr"}
+		}
+		if !strings.HasPrefix(conf.Upstream.Webhook.Path, "/") {
+			return nil, fmt.Errorf("invalid config file: upstream.webhook.path must start with \"/\"")
+		}
+	}
 	if len(conf.Downstream.ListenAddr) == 0 {
 		return nil, &errConfigFieldIsEmpty{field: "downstream.listen_addr"}
 	}
@@ -93,10 +505,116 @@ func Load(path string) (*Config, error) {
 	if len(conf.Downstream.AuthToken) == 0 {
 		return nil, &errConfigFieldIsEmpty{field: "downstream.auth_token"}
 	}
+	if len(conf.Downstream.TLSCert) != 0 && len(conf.Downstream.TLSKey) == 0 {
+		return nil, &errConfigFieldIsEmpty{field: "downstream.tls_key"}
+	}
+	if len(conf.Downstream.TLSKey) != 0 && len(conf.Downstream.TLSCert) == 0 {
+		return nil, &errConfigFieldIsEmpty{field: "downstream.tls_cert"}
+	}
+	if conf.Downstream.ReadHeaderTimeout == 0 {
+		return nil, &errConfigDurationIsTooShort{field: "downstream.read_header_timeout"}
+	}
+	if path, ok := strings.CutPrefix(conf.Downstream.ListenAddr, "unix:"); ok {
+		if len(path) == 0 {
+			return nil, fmt.Errorf("invalid config file: downstream.listen_addr must be followed by a path after \"unix:\"")
+		}
+		// Clients of a Unix socket have no address to check
+		if len(conf.Downstream.AllowedCIDRs) != 0 {
+			return nil, fmt.Errorf("invalid config file: downstream.allowed_cidrs cannot be used with a Unix socket, use downstream.socket_mode instead")
+		}
+		if conf.Downstream.SocketMode > 0o777 {
+			return nil, fmt.Errorf("invalid config file: downstream.socket_mode must be a permission like 0o660")
+		}
+	}
+	for _, cidr := range conf.Downstream.AllowedCIDRs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			// A bare address allows just itself
+			addr, addrErr := netip.ParseAddr(cidr)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid config file: downstream.allowed_cidrs is invalid: %v", err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		conf.Downstream.AllowedPrefixes = append(conf.Downstream.AllowedPrefixes, prefix.Masked())
+	}
+	// Telegram matches method names case-insensitively, so must we, or "SENDMESSAGE" would slip through
+	for i, method := range conf.Downstream.AllowedMethods {
+		conf.Downstream.AllowedMethods[i] = strings.ToLower(method)
+	}
+	for i, method := range conf.Downstream.BlockedMethods {
+		conf.Downstream.BlockedMethods[i] = strings.ToLower(method)
+	}
+	if conf.Downstream.RateLimit < 0 {
+		return nil, fmt.Errorf("invalid config file: downstream.rate_limit must not be negative")
+	}
+	if conf.Downstream.RateLimit != 0 && conf.Downstream.RateLimitBurst == 0 {
+		return nil, &errConfigFieldIsEmpty{field: "downstream.rate_limit_burst"}
+	}
+	if conf.Downstream.WebhookTimeout == 0 {
+		return nil, &errConfigDurationIsTooShort{field: "downstream.webhook_timeout"}
+	}
+	if len(conf.Downstream.HealthPath) != 0 && conf.Downstream.HealthStaleAfter == 0 {
+		return nil, &errConfigDurationIsTooShort{field: "downstream.health_stale_after"}
+	}
+	err = conf.Downstream.LogLevelValue.UnmarshalText([]byte(conf.Downstream.LogLevel))
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file: downstream.log_level must be \"debug\", \"info\", \"warn\", or \"error\"")
+	}
+	if conf.Downstream.LogFormat != "text" && conf.Downstream.LogFormat != "json" {
+		return nil, fmt.Errorf("invalid config file: downstream.log_format must be \"text\" or \"json\"")
+	}
+
+	// Expand URL templates, leaving only the per-request placeholder
+	if strings.Count(conf.Upstream.ApiTemplate, "{method}") != 1 {
+		return nil, fmt.Errorf("invalid config file: upstream.api_template must contain exactly one {method}")
+	}
+	if strings.Count(conf.Upstream.FileTemplate, "{file_path}") != 1 {
+		return nil, fmt.Errorf("invalid config file: upstream.file_template must contain exactly one {file_path}")
+	}
+	templateReplacer := strings.NewReplacer(
+		"{api_url}", conf.Upstream.ApiUrl,
+		"{file_url}", conf.Upstream.FileUrl,
+		"{token}", url.PathEscape(conf.Upstream.AuthToken),
+	)
+	apiTemplate := conf.Upstream.ApiTemplate
+	fileTemplate := conf.Upstream.FileTemplate
+	if conf.Upstream.TestEnvironment {
+		// Telegram serves its test environment under an extra path segment right before the method or file path
+		apiTemplate = strings.Replace(apiTemplate, "{method}", "test/{method}", 1)
+		fileTemplate = strings.Replace(fileTemplate, "{file_path}", "test/{file_path}", 1)
+	}
+	conf.Upstream.ApiPrefix = templateReplacer.Replace(apiTemplate)
+	conf.Upstream.FilePrefix = templateReplacer.Replace(fileTemplate)
+	err = checkExpandedURL("upstream.api_template", conf.Upstream.ApiURL("getUpdates", ""), conf.Upstream.ApiTemplate, "{api_url}", apiURL)
+	if err != nil {
+		return nil, err
+	}
+	err = checkExpandedURL("upstream.file_template", conf.Upstream.FileURL("file", ""), conf.Upstream.FileTemplate, "{file_url}", fileURL)
+	if err != nil {
+		return nil, err
+	}
 
-	// Join prefixes
-	conf.Upstream.ApiPrefix = conf.Upstream.ApiUrl + url.PathEscape(conf.Upstream.AuthToken)
-	conf.Upstream.FilePrefix = conf.Upstream.FileUrl + url.PathEscape(conf.Upstream.AuthToken)
+	// Expand "*" to every known type, since an empty list means everything except chat_member and a few others.
+	// Expand "business" to the types a bot working only for business accounts needs.
+	expanded := make([]string, 0, len(conf.Upstream.FilterUpdateTypes))
+	for _, t := range conf.Upstream.FilterUpdateTypes {
+		var types []string
+		switch t {
+		case "*":
+			types = KnownUpdateTypes
+		case "business":
+			types = BusinessUpdateTypes
+		default:
+			types = []string{t}
+		}
+		for _, t := range types {
+			if !slices.Contains(expanded, t) {
+				expanded = append(expanded, t)
+			}
+		}
+	}
+	conf.Upstream.FilterUpdateTypes = expanded
 
 	// Convert FilterUpdateTypes to string
 	filterUpdateTypesBuf, err := json.Marshal(conf.Upstream.FilterUpdateTypes)
@@ -105,6 +623,13 @@ func Load(path string) (*Config, error) {
 	}
 	conf.Upstream.FilterUpdateTypesStr = url.QueryEscape(string(filterUpdateTypesBuf))
 
+	// Other methods take parameters besides chat_id, such as user_id, and the cache would mix up their results
+	for method := range conf.Upstream.ReadCache {
+		if !slices.Contains(ReadCacheMethods, method) {
+			return nil, fmt.Errorf("invalid config file: upstream.read_cache does not support %s, only %s", method, strings.Join(ReadCacheMethods, ", "))
+		}
+	}
+
 	// Split prefixes
 	apiPrefix, err := url.ParseRequestURI(conf.Downstream.ApiPath)
 	if err != nil {
@@ -132,6 +657,148 @@ func Load(path string) (*Config, error) {
 	return conf, nil
 }
 
+// configFilesIn returns path itself, or the *.conf files in it in lexical order if it is a directory.
+func configFilesIn(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	return filepath.Glob(filepath.Join(path, "*.conf"))
+}
+
+// decodeConfigFile decodes a single file into conf, then the files it includes.
+// Included files may not include further files, which keeps the precedence easy to follow.
+func decodeConfigFile(conf *Config, path string, allowInclude bool) error {
+	conf.Include = nil
+	md, err := toml.DecodeFile(path, conf)
+	if err != nil {
+		return fmt.Errorf("failed to load config file %s: %v", path, err)
+	}
+	// A misspelled key would otherwise silently leave its option at the default
+	if undecoded := md.Undecoded(); len(undecoded) != 0 {
+		keys := make([]string, len(undecoded))
+		for i, key := range undecoded {
+			keys[i] = key.String()
+		}
+		return fmt.Errorf("invalid config file %s: unknown keys %s", path, strings.Join(keys, ", "))
+	}
+	if len(conf.Include) == 0 {
+		return nil
+	}
+	if !allowInclude {
+		return fmt.Errorf("invalid config file %s: included files may not include other files", path)
+	}
+	for _, pattern := range conf.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		includes := []string{pattern}
+		// A plain path must exist, but a pattern matching nothing is just an empty directory
+		if strings.ContainsAny(pattern, "*?[") {
+			includes, err = filepath.Glob(pattern)
+			if err != nil {
+				return fmt.Errorf("invalid config file %s: include %q is invalid: %v", path, pattern, err)
+			}
+		}
+		for _, include := range includes {
+			err = decodeConfigFile(conf, include, false)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// expandEnv replaces each ${VAR} in a config value with the environment variable VAR, which must be set.
+// Unlike in expandPath, a $ without braces is kept as is, since tokens may contain one.
+func expandEnv(field string, value string) (string, error) {
+	var expanded strings.Builder
+	for {
+		start := strings.Index(value, "${")
+		if start < 0 {
+			expanded.WriteString(value)
+			return expanded.String(), nil
+		}
+		length := strings.IndexByte(value[start:], '}')
+		if length < 0 {
+			return "", fmt.Errorf("invalid config file: %s has a ${ without a matching }", field)
+		}
+		name := value[start+2 : start+length]
+		env, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("invalid config file: %s refers to environment variable %s, which is not set", field, name)
+		}
+		expanded.WriteString(value[:start])
+		expanded.WriteString(env)
+		value = value[start+length+1:]
+	}
+}
+
+// expandPath replaces $VAR and ${VAR} with environment variables, which must be set, then a leading ~ with the home directory.
+// An unset variable is an error rather than "", which would turn "$STATE_DIR/tbmux.db" into a file in the root directory.
+func expandPath(path string) (string, error) {
+	var unset []string
+	path = os.Expand(path, func(name string) string {
+		env, ok := os.LookupEnv(name)
+		if !ok {
+			unset = append(unset, name)
+		}
+		return env
+	})
+	if len(unset) != 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(unset, ", "))
+	}
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return home + path[1:], nil
+}
+
+// MethodAllowed checks a method forwarded to upstream against allowed_methods and blocked_methods.
+func (d *ConfigDownstream) MethodAllowed(method string) bool {
+	method = strings.ToLower(method)
+	if len(d.AllowedMethods) != 0 && !slices.Contains(d.AllowedMethods, method) {
+		return false
+	}
+	return !slices.Contains(d.BlockedMethods, method)
+}
+
+// UserAgentHeader is user_agent followed by our own product token, so Telegram can still tell requests come from tbmux.
+func (u *ConfigUpstream) UserAgentHeader() string {
+	if len(u.UserAgent) == 0 {
+		return UserAgent
+	}
+	return u.UserAgent + " " + UserAgent
+}
+
+// ApiURL builds the upstream URL for an API method, with an optional raw query string.
+func (u *ConfigUpstream) ApiURL(method string, query string) string {
+	return joinQuery(strings.Replace(u.ApiPrefix, "{method}", method, 1), query)
+}
+
+// FileURL builds the upstream URL for a file path, with an optional raw query string.
+func (u *ConfigUpstream) FileURL(filePath string, query string) string {
+	return joinQuery(strings.Replace(u.FilePrefix, "{file_path}", filePath, 1), query)
+}
+
+func joinQuery(u string, query string) string {
+	if len(query) == 0 {
+		return u
+	}
+	if strings.Contains(u, "?") {
+		return u + "&" + query
+	}
+	return u + "?" + query
+}
+
 type errConfigFieldIsEmpty struct {
 	field string
 }
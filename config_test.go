@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings []string
+		wantErr  string
+	}{
+		{
+			name:     "read_cache method depending on user_id",
+			settings: []string{"upstream.read_cache.getChatMember = 60"},
+			wantErr:  "upstream.read_cache",
+		},
+		{
+			name:     "read_cache method without chat_id",
+			settings: []string{"upstream.read_cache.getUserProfilePhotos = 60"},
+			wantErr:  "upstream.read_cache",
+		},
+		{
+			name:     "misspelled retention type",
+			settings: []string{"retention.types.edited_mesage = 3600"},
+			wantErr:  "retention.types",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(writeTestConfig(t, "", tt.settings...))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Load returned %v, want an error about %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadRetentionTypes(t *testing.T) {
+	conf := testConfig(t, "", "retention.types.edited_message = 3600", "retention.types."+OversizedUpdateType+" = 60")
+	if len(conf.Retention.Types) != 2 {
+		t.Errorf("retention.types = %v, want 2 types", conf.Retention.Types)
+	}
+}
+
+func TestExpandPath(t *testing.T) {
+	t.Setenv("TBMUX_TEST_DIR", "/var/lib/tbmux")
+	t.Setenv("HOME", "/home/tbmux")
+	tests := []struct {
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{path: "tbmux.db", want: "tbmux.db"},
+		{path: "$TBMUX_TEST_DIR/tbmux.db", want: "/var/lib/tbmux/tbmux.db"},
+		{path: "${TBMUX_TEST_DIR}/tbmux.db", want: "/var/lib/tbmux/tbmux.db"},
+		{path: "~/tbmux.db", want: "/home/tbmux/tbmux.db"},
+		{path: "$TBMUX_TEST_UNSET/tbmux.db", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := expandPath(tt.path)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("expandPath(%q) = %q, want an error", tt.path, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("expandPath(%q) = %q, %v, want %q", tt.path, got, err, tt.want)
+		}
+	}
+}
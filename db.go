@@ -1,12 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"iter"
-	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/tidwall/gjson"
@@ -14,17 +23,43 @@ import (
 
 type Database struct {
 	conn            *sql.DB
+	compression     int
 	updateMutex     *sync.Mutex
 	updateQueue     map[uint64]chan<- struct{}
 	nextCancelToken uint64
 }
 
 type DatabaseTx struct {
-	tx *sql.Tx
+	tx          *sql.Tx
+	compression int
 }
 
+// Values of the compression column, recorded per row so the setting can change without rewriting old rows.
+// Never renumber these, databases in the wild depend on them.
+const (
+	dbCompressionNone = 0
+	dbCompressionGzip = 1
+)
+
 func OpenDatabase(conf *Config) (*Database, error) {
-	conn, err := sql.Open("sqlite3", conf.DB)
+	// SQLite creates the file but not the directories leading to it, and only says "unable to open database file" if they are missing
+	path, _, _ := strings.Cut(strings.TrimPrefix(conf.DB, "file:"), "?")
+	if path != ":memory:" && len(path) != 0 {
+		err := os.MkdirAll(filepath.Dir(path), 0o700)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create database directory: %v", err)
+		}
+	}
+	// The driver applies these PRAGMAs to each connection it opens, since busy_timeout and synchronous are per connection
+	dsn := conf.DB
+	if strings.Contains(dsn, "?") {
+		dsn += "&"
+	} else {
+		dsn += "?"
+	}
+	// auto_vacuum only takes effect on a new database, or on an existing one after a VACUUM
+	dsn += fmt.Sprintf("_journal_mode=%s&_synchronous=%s&_busy_timeout=%d&_auto_vacuum=incremental", strings.ToUpper(conf.Database.JournalMode), strings.ToUpper(conf.Database.Synchronous), conf.Database.BusyTimeoutMs)
+	conn, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %v", err)
 	}
@@ -32,17 +67,359 @@ func OpenDatabase(conf *Config) (*Database, error) {
 		"BEGIN;" +
 			"CREATE TABLE IF NOT EXISTS updates (id INTEGER PRIMARY KEY, upstream_id INTEGER UNIQUE, type TEXT NOT NULL, \"update\" JSONB NOT NULL);" +
 			"CREATE TABLE IF NOT EXISTS messages (id INTEGER PRIMARY KEY, message_id INTEGER NOT NULL, message_thread_id INTEGER, chat_id INTEGER NOT NULL, message JSONB NOT NULL);" +
+			"CREATE TABLE IF NOT EXISTS state (key TEXT PRIMARY KEY, value INTEGER NOT NULL);" +
+			"CREATE TABLE IF NOT EXISTS consumers (id TEXT PRIMARY KEY, acked_offset INTEGER NOT NULL);" +
+			"CREATE TABLE IF NOT EXISTS deletions (id INTEGER PRIMARY KEY, chat_id INTEGER NOT NULL, message_id INTEGER NOT NULL, business_connection_id TEXT, delete_at INTEGER NOT NULL);" +
+			"CREATE INDEX IF NOT EXISTS deletions_by_time ON deletions (delete_at);" +
+			"CREATE TABLE IF NOT EXISTS subscriptions (consumer_id TEXT NOT NULL, chat_id INTEGER NOT NULL, PRIMARY KEY (consumer_id, chat_id));" +
+			"CREATE TABLE IF NOT EXISTS upstream_errors (id INTEGER PRIMARY KEY, method TEXT NOT NULL, chat_id TEXT, error_code INTEGER NOT NULL, description TEXT NOT NULL, created_at INTEGER NOT NULL);" +
+			"CREATE TABLE IF NOT EXISTS inline_edits (inline_message_id TEXT PRIMARY KEY, method TEXT NOT NULL, reply_markup TEXT, created_at INTEGER NOT NULL);" +
+			"CREATE TABLE IF NOT EXISTS cached_results (method TEXT PRIMARY KEY, result TEXT NOT NULL, fetched_at INTEGER NOT NULL);" +
+			"CREATE TABLE IF NOT EXISTS webhooks (consumer_id TEXT PRIMARY KEY, url TEXT NOT NULL, secret_token TEXT NOT NULL, allowed_updates TEXT NOT NULL);" +
 			"COMMIT;")
 	if err != nil {
 		return nil, fmt.Errorf("failed to write to database: %v", err)
 	}
+	for _, table := range []string{"updates", "messages"} {
+		_, err = addColumnIfNotExists(conn, table, "compression", "INTEGER NOT NULL DEFAULT 0")
+		if err != nil {
+			return nil, fmt.Errorf("failed to write to database: %v", err)
+		}
+		added, err := addColumnIfNotExists(conn, table, "created_at", "INTEGER NOT NULL DEFAULT 0")
+		if err != nil {
+			return nil, fmt.Errorf("failed to write to database: %v", err)
+		}
+		if added {
+			// We don't know when existing rows were inserted, so start counting their age from now
+			_, err = conn.Exec(fmt.Sprintf("UPDATE %s SET created_at = unixepoch();", table))
+			if err != nil {
+				return nil, fmt.Errorf("failed to write to database: %v", err)
+			}
+		}
+	}
+	_, err = addColumnIfNotExists(conn, "messages", "business_connection_id", "TEXT")
+	if err != nil {
+		return nil, fmt.Errorf("failed to write to database: %v", err)
+	}
+	// Deleted messages stay in the cache with deleted_at set, so they can be told apart from ones we never saw
+	_, err = addColumnIfNotExists(conn, "messages", "deleted_at", "INTEGER")
+	if err != nil {
+		return nil, fmt.Errorf("failed to write to database: %v", err)
+	}
+	// Updates stored before this column existed have no chat, so they reach every consumer regardless of subscriptions
+	_, err = addColumnIfNotExists(conn, "updates", "chat_id", "INTEGER")
+	if err != nil {
+		return nil, fmt.Errorf("failed to write to database: %v", err)
+	}
+	// Business chats share chat IDs with the private chats between users and the bot itself, so they must be looked up separately
+	_, err = conn.Exec("CREATE INDEX IF NOT EXISTS messages_by_chat ON messages (business_connection_id, chat_id, message_id);")
+	if err != nil {
+		return nil, fmt.Errorf("failed to write to database: %v", err)
+	}
+	var autoVacuum int
+	err = conn.QueryRow("PRAGMA auto_vacuum;").Scan(&autoVacuum)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read database: %v", err)
+	}
+	if autoVacuum != dbAutoVacuumIncremental {
+		slog.Info("Database was created without incremental auto_vacuum, so maintenance cannot shrink it until it is VACUUMed once while stopped")
+	}
+	compression := dbCompressionNone
+	if conf.DBCompression == "gzip" {
+		compression = dbCompressionGzip
+	}
 	return &Database{
 		conn:        conn,
+		compression: compression,
 		updateQueue: make(map[uint64]chan<- struct{}),
 		updateMutex: new(sync.Mutex),
 	}, nil
 }
 
+// dbAutoVacuumIncremental is what PRAGMA auto_vacuum returns for incremental mode.
+const dbAutoVacuumIncremental = 2
+
+// errDatabaseBusy means a checkpoint could not finish because of readers or writers holding the database.
+var errDatabaseBusy = errors.New("database is busy")
+
+// StartMaintaining runs Maintain every interval seconds, or sooner again if the database was busy.
+func (d *Database) StartMaintaining(ctx context.Context, conf *ConfigDatabase) {
+	interval := time.Duration(conf.MaintenanceInterval) * time.Second
+	const minRetry = 10 * time.Second
+	retry := minRetry
+	wait := interval
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		err := d.Maintain(ctx)
+		if err == errDatabaseBusy {
+			// Long polls and forwards come and go, so a quieter moment is usually not far off
+			slog.Info("Database is busy, postponing maintenance", "retry_in", retry)
+			wait = retry
+			retry = min(retry*2, interval)
+			continue
+		}
+		if err != nil {
+			slog.Error("Failed to maintain database", "err", err)
+		}
+		wait = interval
+		retry = minRetry
+	}
+}
+
+// Maintain moves the write-ahead log into the database and truncates it, then returns the pages freed by pruning
+// to the file system. Pages freed in a database without incremental auto_vacuum are only reused, not returned.
+func (d *Database) Maintain(ctx context.Context) error {
+	var pageSize, freeBefore, freeAfter int64
+	err := d.conn.QueryRowContext(ctx, "PRAGMA page_size;").Scan(&pageSize)
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	// busy is set if a reader or writer kept the checkpoint from finishing, logPages is -1 without a write-ahead log
+	var busy, logPages, checkpointed int64
+	err = d.conn.QueryRowContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE);").Scan(&busy, &logPages, &checkpointed)
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	if busy != 0 {
+		return errDatabaseBusy
+	}
+	err = d.conn.QueryRowContext(ctx, "PRAGMA freelist_count;").Scan(&freeBefore)
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	// Each step frees some pages, so it must be stepped until done rather than executed once
+	rows, err := d.conn.QueryContext(ctx, "PRAGMA incremental_vacuum;")
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	for rows.Next() {
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	err = d.conn.QueryRowContext(ctx, "PRAGMA freelist_count;").Scan(&freeAfter)
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	slog.Info("Database maintenance done", "wal_bytes", max(logPages, 0)*pageSize, "reclaimed_bytes", (freeBefore-freeAfter)*pageSize, "free_bytes", freeAfter*pageSize)
+	return nil
+}
+
+// DatabaseStats is a snapshot of how much the database holds, for telling when retention needs tuning.
+type DatabaseStats struct {
+	Messages uint64
+	Updates  uint64
+	// Undelivered counts, for each consumer that ever called getUpdates, the updates it has not confirmed yet
+	Undelivered map[string]uint64
+	// Size is the size of the database file, not counting the write-ahead log
+	Size int64
+}
+
+// Stats counts rows the same way getUpdates would, so it scans the tables and should not be called often.
+func (d *Database) Stats(ctx context.Context) (*DatabaseStats, error) {
+	stats := &DatabaseStats{
+		Undelivered: make(map[string]uint64),
+	}
+	var pageCount, pageSize int64
+	err := d.conn.QueryRowContext(ctx, "SELECT (SELECT COUNT(*) FROM messages), (SELECT COUNT(*) FROM updates), (SELECT page_count FROM pragma_page_count()), (SELECT page_size FROM pragma_page_size());").Scan(&stats.Messages, &stats.Updates, &pageCount, &pageSize)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	stats.Size = pageCount * pageSize
+	rows, err := d.conn.QueryContext(ctx, "SELECT id, acked_offset FROM consumers;")
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	offsets := make(map[string]int64)
+	for rows.Next() {
+		var consumerID string
+		var offset int64
+		err = rows.Scan(&consumerID, &offset)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("database error: %v", err)
+		}
+		offsets[consumerID] = offset
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	for consumerID, offset := range offsets {
+		stats.Undelivered[consumerID], err = d.CountUpdates(ctx, consumerID, max(offset, 1), nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return stats, nil
+}
+
+// Close checkpoints the write-ahead log, if there is one, so the database file is complete on its own, then closes it.
+func (d *Database) Close() error {
+	_, err := d.conn.Exec("PRAGMA wal_checkpoint(TRUNCATE);")
+	if err != nil {
+		slog.Error("Failed to checkpoint database", "err", err)
+	}
+	return d.conn.Close()
+}
+
+// addColumnIfNotExists upgrades tables created by an older version.
+func addColumnIfNotExists(conn *sql.DB, table string, column string, decl string) (bool, error) {
+	var count int
+	err := conn.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?;", table, column).Scan(&count)
+	if err != nil || count != 0 {
+		return false, err
+	}
+	slog.Info("Upgrading database: adding column", "table", table, "column", column)
+	_, err = conn.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s;", table, column, decl))
+	return err == nil, err
+}
+
+func (d *Database) StartPruning(ctx context.Context, conf *ConfigRetention) {
+	ticker := time.NewTicker(time.Duration(conf.PruneInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		err := d.Prune(ctx, conf)
+		if err != nil {
+			slog.Error("Failed to prune database", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Prune deletes updates older than their per-type retention, falling back to MaxAge.
+// A retention of 0 keeps rows forever.
+func (d *Database) Prune(ctx context.Context, conf *ConfigRetention) error {
+	now := time.Now().Unix()
+	tx, err := d.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	defer tx.Rollback()
+
+	// The newest update is never deleted. update_id is the rowid, which SQLite picks as one above the highest left,
+	// so deleting the newest would hand its update_id out again, to an update skipped by consumers that confirmed it.
+	keep := " AND id < (SELECT MAX(id) FROM updates)"
+	if conf.KeepUndelivered {
+		// Consumers confirm updates by asking for a higher offset, so the lowest confirmed offset is where undelivered updates begin
+		keep += " AND id < (SELECT IFNULL(MIN(acked_offset), 9223372036854775807) FROM consumers)"
+	}
+
+	otherTypes := make([]any, 0, len(conf.Types))
+	for updateType, maxAge := range conf.Types {
+		otherTypes = append(otherTypes, updateType)
+		if maxAge == 0 {
+			continue
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM updates WHERE type = ? AND created_at < ?"+keep+";", updateType, now-int64(maxAge))
+		if err != nil {
+			return fmt.Errorf("database error: %v", err)
+		}
+	}
+	if conf.MaxAge != 0 {
+		cutoff := now - int64(conf.MaxAge)
+		if len(otherTypes) == 0 {
+			_, err = tx.ExecContext(ctx, "DELETE FROM updates WHERE created_at < ?"+keep+";", cutoff)
+		} else {
+			placeholders := strings.Repeat(", ?", len(otherTypes))[2:]
+			_, err = tx.ExecContext(ctx, "DELETE FROM updates WHERE type NOT IN ("+placeholders+") AND created_at < ?"+keep+";", append(otherTypes, cutoff)...)
+		}
+		if err != nil {
+			return fmt.Errorf("database error: %v", err)
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM messages WHERE created_at < ?;", cutoff)
+		if err != nil {
+			return fmt.Errorf("database error: %v", err)
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM inline_edits WHERE created_at < ?;", cutoff)
+		if err != nil {
+			return fmt.Errorf("database error: %v", err)
+		}
+	}
+	if conf.CompactEdits != 0 {
+		err = compactEdits(ctx, tx, now-int64(conf.CompactEdits))
+		if err != nil {
+			return err
+		}
+	}
+	if conf.Errors != 0 {
+		_, err = tx.ExecContext(ctx, "DELETE FROM upstream_errors WHERE created_at < ?;", now-int64(conf.Errors))
+		if err != nil {
+			return fmt.Errorf("database error: %v", err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	return nil
+}
+
+// compactEdits deletes edits stored before cutoff, except the last one of each message among them.
+// Every edit carries the whole message, so a consumer that has not read the deleted ones still ends up with its final state,
+// it only misses the intermediate versions. Edits after cutoff are left alone.
+func compactEdits(ctx context.Context, tx *sql.Tx, cutoff int64) error {
+	rows, err := tx.QueryContext(ctx, "SELECT id, compression, "+dbSelectJSON("\"update\"")+" FROM updates WHERE type IN ('edited_message', 'edited_channel_post', 'edited_business_message') AND created_at < ? ORDER BY id ASC;", cutoff)
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	type messageKey struct {
+		businessConnectionID string
+		chatID               int64
+		messageID            int64
+	}
+	latest := make(map[messageKey]int64)
+	var superseded []int64
+	for rows.Next() {
+		var id int64
+		var compression int
+		var updateBuf []byte
+		err = rows.Scan(&id, &compression, &updateBuf)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("database error: %v", err)
+		}
+		updateValue, err := decompressJSON(updateBuf, compression)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("database error: %v", err)
+		}
+		message := gjson.Parse(updateValue)
+		key := messageKey{
+			businessConnectionID: message.Get("business_connection_id").String(),
+			chatID:               message.Get("chat.id").Int(),
+			messageID:            message.Get("message_id").Int(),
+		}
+		if previous, ok := latest[key]; ok {
+			superseded = append(superseded, previous)
+		}
+		latest[key] = id
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	for _, id := range superseded {
+		_, err = tx.ExecContext(ctx, "DELETE FROM updates WHERE id = ?;", id)
+		if err != nil {
+			return fmt.Errorf("database error: %v", err)
+		}
+	}
+	return nil
+}
+
 func (d *Database) SubscribeNextUpdate() (<-chan struct{}, func()) {
 	c := make(chan struct{})
 	d.updateMutex.Lock()
@@ -66,13 +443,38 @@ func (d *Database) NotifyUpdates() {
 	d.updateMutex.Unlock()
 }
 
-func (d *Database) GetUpdates(ctx context.Context, offset int64, limit uint64) iter.Seq2[string, error] {
+// dbSubscribedUpdates filters updates down to the chats a consumer subscribed to, binding the consumer ID twice.
+// Consumers without subscriptions get every chat, and updates without a chat, like inline queries, reach everyone.
+const dbSubscribedUpdates = "(chat_id IS NULL OR NOT EXISTS (SELECT 1 FROM subscriptions WHERE consumer_id = ?) OR chat_id IN (SELECT chat_id FROM subscriptions WHERE consumer_id = ?))"
+
+// dbUpdateTypes filters updates down to the given types, or returns an empty filter if there are none.
+func dbUpdateTypes(updateTypes []string) (string, []any) {
+	if len(updateTypes) == 0 {
+		return "", nil
+	}
+	args := make([]any, len(updateTypes))
+	for i, t := range updateTypes {
+		args[i] = t
+	}
+	return " AND type IN (?" + strings.Repeat(", ?", len(updateTypes)-1) + ")", args
+}
+
+// GetUpdates returns the updates a consumer has not confirmed yet, limited to updateTypes unless it is empty.
+//
+// Updates come in the order we stored them, which is also the order of the update_id we give them, as SQLite
+// assigns the rowid under the write lock and Prune never lets one be reused. Echoes of sends and edits are stored
+// as soon as upstream answers, so they interleave with polled updates by when each was stored, not by Telegram's
+// update_id or date. Updates of one poll are stored in one transaction and stay in upstream's order.
+func (d *Database) GetUpdates(ctx context.Context, consumerID string, offset int64, limit uint64, updateTypes []string) iter.Seq2[string, error] {
 	var rows *sql.Rows
 	var err error
+	typeFilter, typeArgs := dbUpdateTypes(updateTypes)
 	if offset > 0 {
-		rows, err = d.conn.QueryContext(ctx, "SELECT id, type, json(\"update\") FROM updates WHERE id >= ? ORDER BY id ASC LIMIT ?;", offset, limit)
+		args := append(append([]any{offset, consumerID, consumerID}, typeArgs...), limit)
+		rows, err = d.conn.QueryContext(ctx, "SELECT id, type, compression, "+dbSelectJSON("\"update\"")+" FROM updates WHERE id >= ? AND "+dbSubscribedUpdates+typeFilter+" ORDER BY id ASC LIMIT ?;", args...)
 	} else {
-		rows, err = d.conn.QueryContext(ctx, "SELECT id, type, json(\"update\") FROM (SELECT * FROM updates ORDER BY id DESC LIMIT ?) ORDER BY id ASC LIMIT ?;", -offset, limit)
+		args := append(append([]any{consumerID, consumerID}, typeArgs...), -offset, limit)
+		rows, err = d.conn.QueryContext(ctx, "SELECT id, type, compression, "+dbSelectJSON("\"update\"")+" FROM (SELECT * FROM updates WHERE "+dbSubscribedUpdates+typeFilter+" ORDER BY id DESC LIMIT ?) ORDER BY id ASC LIMIT ?;", args...)
 	}
 	if err != nil {
 		return func(yield func(string, error) bool) {
@@ -82,8 +484,16 @@ func (d *Database) GetUpdates(ctx context.Context, offset int64, limit uint64) i
 	return func(yield func(string, error) bool) {
 		for rows.Next() {
 			var id uint64
-			var updateType, updateValue string
-			err := rows.Scan(&id, &updateType, &updateValue)
+			var updateType string
+			var compression int
+			var updateBuf []byte
+			err := rows.Scan(&id, &updateType, &compression, &updateBuf)
+			if err != nil {
+				yield("", fmt.Errorf("database error: %v", err))
+				rows.Close()
+				return
+			}
+			updateValue, err := decompressJSON(updateBuf, compression)
 			if err != nil {
 				yield("", fmt.Errorf("database error: %v", err))
 				rows.Close()
@@ -104,10 +514,516 @@ func (d *Database) GetUpdates(ctx context.Context, offset int64, limit uint64) i
 	}
 }
 
+// RebuildMessageCache repopulates the messages table from stored updates of the given types.
+// Updates are replayed in id order, so for an edited message the latest version still gets the highest row id.
+// Progress is committed after every batch, so an interrupted rebuild resumes where it stopped when run again.
+// Rows of deleted messages are kept, and mark the rebuilt versions deleted at the end, since updates never record deletions.
+func (d *Database) RebuildMessageCache(ctx context.Context, updateTypes []string, progress func(done, total uint64)) error {
+	const batchSize = 1000
+	if len(updateTypes) == 0 {
+		return nil
+	}
+	typeArgs := make([]any, len(updateTypes))
+	for i, t := range updateTypes {
+		typeArgs[i] = t
+	}
+	typePlaceholders := strings.Repeat(", ?", len(updateTypes))[2:]
+
+	var cursor int64
+	err := d.conn.QueryRowContext(ctx, "SELECT value FROM state WHERE key = 'rebuild_cursor';").Scan(&cursor)
+	if err == sql.ErrNoRows {
+		slog.Info("Clearing message cache")
+		_, err = d.conn.ExecContext(ctx, "BEGIN; DELETE FROM messages WHERE deleted_at IS NULL; INSERT INTO state (key, value) VALUES ('rebuild_cursor', 0); COMMIT;")
+	} else if err == nil {
+		slog.Info("Resuming message cache rebuild", "after_update_id", cursor)
+	}
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+
+	var done, total uint64
+	err = d.conn.QueryRowContext(ctx, "SELECT COUNT(*) FILTER (WHERE id <= ?), COUNT(*) FROM updates WHERE type IN ("+typePlaceholders+");", append([]any{cursor}, typeArgs...)...).Scan(&done, &total)
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	progress(done, total)
+
+	for {
+		rows, err := d.conn.QueryContext(ctx, "SELECT id, compression, "+dbSelectJSON("\"update\"")+" FROM updates WHERE id > ? AND type IN ("+typePlaceholders+") ORDER BY id ASC LIMIT ?;", append(append([]any{cursor}, typeArgs...), batchSize)...)
+		if err != nil {
+			return fmt.Errorf("database error: %v", err)
+		}
+		type storedUpdate struct {
+			id    int64
+			value string
+		}
+		var batch []storedUpdate
+		for rows.Next() {
+			var u storedUpdate
+			var compression int
+			var buf []byte
+			err = rows.Scan(&u.id, &compression, &buf)
+			if err == nil {
+				u.value, err = decompressJSON(buf, compression)
+			}
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("database error: %v", err)
+			}
+			batch = append(batch, u)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return fmt.Errorf("database error: %v", err)
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		tx, err := d.BeginTx()
+		if err != nil {
+			return fmt.Errorf("database error: %v", err)
+		}
+		for _, u := range batch {
+			message := gjson.Parse(u.value)
+			err = tx.InsertMessage(&message)
+			if err != nil {
+				tx.tx.Rollback()
+				return err
+			}
+		}
+		cursor = batch[len(batch)-1].id
+		_, err = tx.tx.Exec("UPDATE state SET value = ? WHERE key = 'rebuild_cursor';", cursor)
+		if err != nil {
+			tx.tx.Rollback()
+			return fmt.Errorf("database error: %v", err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("database error: %v", err)
+		}
+		done += uint64(len(batch))
+		progress(done, total)
+	}
+
+	_, err = d.conn.ExecContext(ctx,
+		"BEGIN; "+
+			"UPDATE messages SET deleted_at = t.deleted_at FROM (SELECT business_connection_id, chat_id, message_id, MAX(deleted_at) AS deleted_at FROM messages WHERE deleted_at IS NOT NULL GROUP BY business_connection_id, chat_id, message_id) AS t "+
+			"WHERE messages.deleted_at IS NULL AND messages.business_connection_id IS t.business_connection_id AND messages.chat_id = t.chat_id AND messages.message_id = t.message_id; "+
+			"DELETE FROM state WHERE key = 'rebuild_cursor'; "+
+			"COMMIT;",
+	)
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	return nil
+}
+
+// LoadOffset returns the offset into upstream's updates saved by SaveOffset, along with the bot and time it was saved for.
+// offset is 0 if none was saved yet.
+func (d *Database) LoadOffset(ctx context.Context) (offset uint64, botID int64, savedAt time.Time, err error) {
+	rows, err := d.conn.QueryContext(ctx, "SELECT key, value FROM state WHERE key IN ('upstream_offset', 'upstream_bot_id', 'upstream_offset_time');")
+	if err != nil {
+		return 0, 0, time.Time{}, fmt.Errorf("database error: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var value int64
+		err = rows.Scan(&key, &value)
+		if err != nil {
+			return 0, 0, time.Time{}, fmt.Errorf("database error: %v", err)
+		}
+		switch key {
+		case "upstream_offset":
+			offset = uint64(value)
+		case "upstream_bot_id":
+			botID = value
+		case "upstream_offset_time":
+			savedAt = time.Unix(value, 0)
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return 0, 0, time.Time{}, fmt.Errorf("database error: %v", err)
+	}
+	return offset, botID, savedAt, nil
+}
+
+// ConsumerOffset returns the offset a consumer has acknowledged up to, or 0 if it never did.
+func (d *Database) ConsumerOffset(ctx context.Context, consumerID string) (int64, error) {
+	var offset int64
+	err := d.conn.QueryRowContext(ctx, "SELECT acked_offset FROM consumers WHERE id = ?;", consumerID).Scan(&offset)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("database error: %v", err)
+	}
+	return offset, nil
+}
+
+// AckOffset records that a consumer has processed every update below offset, and returns the offset recorded.
+// Offsets never move backwards, and never beyond the newest update, so an offset far past it confirms everything,
+// like with Telegram, instead of also skipping updates yet to come.
+func (d *Database) AckOffset(ctx context.Context, consumerID string, offset int64) (int64, error) {
+	err := d.conn.QueryRowContext(ctx, "SELECT MIN(?, IFNULL(MAX(id), 0) + 1) FROM updates;", offset).Scan(&offset)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %v", err)
+	}
+	_, err = d.conn.ExecContext(ctx,
+		"INSERT INTO consumers (id, acked_offset) VALUES (?, ?) ON CONFLICT (id) DO UPDATE SET acked_offset = MAX(acked_offset, excluded.acked_offset);",
+		consumerID, offset,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %v", err)
+	}
+	return offset, nil
+}
+
+// CountUpdates counts the updates getUpdates would return for offset, ignoring its limit.
+// id is the rowid, so this is a range scan over the primary key and needs no extra index.
+func (d *Database) CountUpdates(ctx context.Context, consumerID string, offset int64, updateTypes []string) (uint64, error) {
+	var count uint64
+	var err error
+	typeFilter, typeArgs := dbUpdateTypes(updateTypes)
+	if offset > 0 {
+		args := append([]any{offset, consumerID, consumerID}, typeArgs...)
+		err = d.conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM updates WHERE id >= ? AND "+dbSubscribedUpdates+typeFilter+";", args...).Scan(&count)
+	} else {
+		args := append([]any{-offset, consumerID, consumerID}, typeArgs...)
+		err = d.conn.QueryRowContext(ctx, "SELECT MIN(COUNT(*), ?) FROM updates WHERE "+dbSubscribedUpdates+typeFilter+";", args...).Scan(&count)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("database error: %v", err)
+	}
+	return count, nil
+}
+
+func (d *Database) Subscribe(ctx context.Context, consumerID string, chatID int64) error {
+	_, err := d.conn.ExecContext(ctx, "INSERT OR IGNORE INTO subscriptions (consumer_id, chat_id) VALUES (?, ?);", consumerID, chatID)
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	return nil
+}
+
+func (d *Database) Unsubscribe(ctx context.Context, consumerID string, chatID int64) error {
+	_, err := d.conn.ExecContext(ctx, "DELETE FROM subscriptions WHERE consumer_id = ? AND chat_id = ?;", consumerID, chatID)
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	return nil
+}
+
+func (d *Database) Subscriptions(ctx context.Context, consumerID string) ([]int64, error) {
+	rows, err := d.conn.QueryContext(ctx, "SELECT chat_id FROM subscriptions WHERE consumer_id = ? ORDER BY chat_id ASC;", consumerID)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	defer rows.Close()
+	chatIDs := []int64{}
+	for rows.Next() {
+		var chatID int64
+		err = rows.Scan(&chatID)
+		if err != nil {
+			return nil, fmt.Errorf("database error: %v", err)
+		}
+		chatIDs = append(chatIDs, chatID)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	return chatIDs, nil
+}
+
+// ConsumerWebhook is a webhook set by a consumer with setWebhook, to receive its updates from us instead of calling getUpdates.
+type ConsumerWebhook struct {
+	ConsumerID     string
+	URL            string
+	SecretToken    string
+	AllowedUpdates []string
+}
+
+// SetWebhook stores a consumer's webhook, replacing the one it had.
+// A consumer that never confirmed an offset starts after the newest update, and dropPending moves any consumer there.
+func (d *Database) SetWebhook(ctx context.Context, hook *ConsumerWebhook, dropPending bool) error {
+	allowedUpdates, _ := json.Marshal(hook.AllowedUpdates)
+	tx, err := d.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO webhooks (consumer_id, url, secret_token, allowed_updates) VALUES (?, ?, ?, ?) ON CONFLICT (consumer_id) DO UPDATE SET url = excluded.url, secret_token = excluded.secret_token, allowed_updates = excluded.allowed_updates;",
+		hook.ConsumerID, hook.URL, hook.SecretToken, string(allowedUpdates),
+	)
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	err = skipPendingUpdates(ctx, tx, hook.ConsumerID, dropPending)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	return nil
+}
+
+// DeleteWebhook removes a consumer's webhook, if it has one, so it can call getUpdates again.
+func (d *Database) DeleteWebhook(ctx context.Context, consumerID string, dropPending bool) error {
+	tx, err := d.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, "DELETE FROM webhooks WHERE consumer_id = ?;", consumerID)
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	if dropPending {
+		err = skipPendingUpdates(ctx, tx, consumerID, true)
+		if err != nil {
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	return nil
+}
+
+// skipPendingUpdates confirms every stored update on behalf of a consumer, or only does so for a new consumer unless all is set.
+func skipPendingUpdates(ctx context.Context, tx *sql.Tx, consumerID string, all bool) error {
+	conflict := " ON CONFLICT (id) DO NOTHING;"
+	if all {
+		conflict = " ON CONFLICT (id) DO UPDATE SET acked_offset = MAX(acked_offset, excluded.acked_offset);"
+	}
+	// SQLite needs the WHERE to tell ON CONFLICT apart from a join constraint of the SELECT
+	_, err := tx.ExecContext(ctx, "INSERT INTO consumers (id, acked_offset) SELECT ?, IFNULL(MAX(id), 0) + 1 FROM updates WHERE true"+conflict, consumerID)
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	return nil
+}
+
+func (d *Database) Webhooks(ctx context.Context) ([]ConsumerWebhook, error) {
+	rows, err := d.conn.QueryContext(ctx, "SELECT consumer_id, url, secret_token, allowed_updates FROM webhooks ORDER BY consumer_id ASC;")
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	defer rows.Close()
+	var hooks []ConsumerWebhook
+	for rows.Next() {
+		var hook ConsumerWebhook
+		var allowedUpdates string
+		err = rows.Scan(&hook.ConsumerID, &hook.URL, &hook.SecretToken, &allowedUpdates)
+		if err != nil {
+			return nil, fmt.Errorf("database error: %v", err)
+		}
+		json.Unmarshal([]byte(allowedUpdates), &hook.AllowedUpdates)
+		hooks = append(hooks, hook)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	return hooks, nil
+}
+
+// CachedResult returns the result of an API method cached by PutCachedResult, and when it was fetched, or "" if there is none.
+func (d *Database) CachedResult(ctx context.Context, method string) (string, time.Time, error) {
+	var result string
+	var fetchedAt int64
+	err := d.conn.QueryRowContext(ctx, "SELECT result, fetched_at FROM cached_results WHERE method = ?;", method).Scan(&result, &fetchedAt)
+	if err == sql.ErrNoRows {
+		return "", time.Time{}, nil
+	}
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("database error: %v", err)
+	}
+	return result, time.Unix(fetchedAt, 0), nil
+}
+
+func (d *Database) PutCachedResult(ctx context.Context, method string, result string) error {
+	_, err := d.conn.ExecContext(ctx, "INSERT INTO cached_results (method, result, fetched_at) VALUES (?, ?, unixepoch()) ON CONFLICT (method) DO UPDATE SET result = excluded.result, fetched_at = excluded.fetched_at;", method, result)
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	return nil
+}
+
+func (d *Database) InsertUpstreamError(method string, chatRef string, errorCode int64, description string) error {
+	_, err := d.conn.Exec("INSERT INTO upstream_errors (method, chat_id, error_code, description, created_at) VALUES (?, NULLIF(?, ''), ?, ?, unixepoch());", method, chatRef, errorCode, description)
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	return nil
+}
+
+// GetUpstreamErrors returns recorded upstream errors as JSON objects, counting offset the same way as GetUpdates.
+func (d *Database) GetUpstreamErrors(ctx context.Context, offset int64, limit uint64) ([]string, error) {
+	const columns = "json_object('id', id, 'date', created_at, 'method', method, 'chat_id', chat_id, 'error_code', error_code, 'description', description)"
+	var rows *sql.Rows
+	var err error
+	if offset > 0 {
+		rows, err = d.conn.QueryContext(ctx, "SELECT "+columns+" FROM upstream_errors WHERE id >= ? ORDER BY id ASC LIMIT ?;", offset, limit)
+	} else {
+		rows, err = d.conn.QueryContext(ctx, "SELECT "+columns+" FROM (SELECT * FROM upstream_errors ORDER BY id DESC LIMIT ?) ORDER BY id ASC LIMIT ?;", -offset, limit)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	defer rows.Close()
+	var upstreamErrors []string
+	for rows.Next() {
+		var errorJSON string
+		err = rows.Scan(&errorJSON)
+		if err != nil {
+			return nil, fmt.Errorf("database error: %v", err)
+		}
+		upstreamErrors = append(upstreamErrors, errorJSON)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	return upstreamErrors, nil
+}
+
+type PendingDeletion struct {
+	ID                   int64
+	ChatID               int64
+	MessageID            int64
+	BusinessConnectionID sql.NullString
+}
+
+// NextDeletionTime reports when the earliest pending deletion is due, or false if there is none.
+func (d *Database) NextDeletionTime(ctx context.Context) (time.Time, bool, error) {
+	var deleteAt sql.NullInt64
+	err := d.conn.QueryRowContext(ctx, "SELECT MIN(delete_at) FROM deletions;").Scan(&deleteAt)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("database error: %v", err)
+	}
+	return time.Unix(deleteAt.Int64, 0), deleteAt.Valid, nil
+}
+
+func (d *Database) DueDeletions(ctx context.Context, now time.Time) ([]PendingDeletion, error) {
+	rows, err := d.conn.QueryContext(ctx, "SELECT id, chat_id, message_id, business_connection_id FROM deletions WHERE delete_at <= ? ORDER BY delete_at ASC;", now.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	defer rows.Close()
+	var deletions []PendingDeletion
+	for rows.Next() {
+		var del PendingDeletion
+		err = rows.Scan(&del.ID, &del.ChatID, &del.MessageID, &del.BusinessConnectionID)
+		if err != nil {
+			return nil, fmt.Errorf("database error: %v", err)
+		}
+		deletions = append(deletions, del)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("database error: %v", err)
+	}
+	return deletions, nil
+}
+
+// GetMessage returns the latest cached version of a message, or an empty string if it is not cached, along with
+// the Unix time we stored that version at, which unlike the message's own date changes with every edit we see.
+// Deleted messages are returned as well, with deleted set.
+func (d *Database) GetMessage(ctx context.Context, chatID int64, messageID int64, businessConnectionID sql.NullString) (string, int64, bool, error) {
+	var compression int
+	var messageBuf []byte
+	var receivedAt int64
+	var deletedAt sql.NullInt64
+	err := d.conn.QueryRowContext(ctx,
+		"SELECT compression, "+dbSelectJSON("message")+", created_at, deleted_at FROM messages WHERE business_connection_id IS ? AND chat_id = ? AND message_id = ? ORDER BY id DESC LIMIT 1;",
+		businessConnectionID, chatID, messageID,
+	).Scan(&compression, &messageBuf, &receivedAt, &deletedAt)
+	if err == sql.ErrNoRows {
+		return "", 0, false, nil
+	}
+	if err != nil {
+		return "", 0, false, fmt.Errorf("database error: %v", err)
+	}
+	message, err := decompressJSON(messageBuf, compression)
+	if err != nil {
+		return "", 0, false, fmt.Errorf("database error: %v", err)
+	}
+	return message, receivedAt, deletedAt.Valid, nil
+}
+
+// InsertInlineEdit records the last edit of an inline message made through us, which upstream answers with just true.
+// replyMarkup is the keyboard the edit set, or empty if it removed the keyboard.
+func (d *Database) InsertInlineEdit(inlineMessageID string, method string, replyMarkup string) error {
+	_, err := d.conn.Exec(
+		"INSERT INTO inline_edits (inline_message_id, method, reply_markup, created_at) VALUES (?, ?, NULLIF(?, ''), unixepoch()) ON CONFLICT (inline_message_id) DO UPDATE SET method = excluded.method, reply_markup = excluded.reply_markup, created_at = excluded.created_at;",
+		inlineMessageID, method, replyMarkup,
+	)
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	return nil
+}
+
+// GetInlineEdit returns the last edit stored by InsertInlineEdit as a JSON object, or "" if there is none.
+func (d *Database) GetInlineEdit(ctx context.Context, inlineMessageID string) (string, error) {
+	var method string
+	var replyMarkup sql.NullString
+	var createdAt int64
+	err := d.conn.QueryRowContext(ctx, "SELECT method, reply_markup, created_at FROM inline_edits WHERE inline_message_id = ?;", inlineMessageID).Scan(&method, &replyMarkup, &createdAt)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("database error: %v", err)
+	}
+	edit := fmt.Sprintf("{\"inline_message_id\":%s,\"method\":%s,\"edit_date\":%d", JSONQuote(inlineMessageID), JSONQuote(method), createdAt)
+	if replyMarkup.Valid && gjson.Valid(replyMarkup.String) {
+		edit += ",\"reply_markup\":" + replyMarkup.String
+	}
+	return edit + "}", nil
+}
+
+func (d *Database) MarkMessageDeleted(chatID int64, messageID int64, businessConnectionID sql.NullString) error {
+	_, err := d.conn.Exec(
+		"UPDATE messages SET deleted_at = unixepoch() WHERE chat_id = ? AND message_id = ? AND business_connection_id IS ? AND deleted_at IS NULL;",
+		chatID, messageID, businessConnectionID,
+	)
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	return nil
+}
+
+func (d *Database) RemoveDeletion(id int64) error {
+	_, err := d.conn.Exec("DELETE FROM deletions WHERE id = ?;", id)
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	return nil
+}
+
+func (d *Database) PostponeDeletion(id int64, deleteAt time.Time) error {
+	_, err := d.conn.Exec("UPDATE deletions SET delete_at = ? WHERE id = ?;", deleteAt.Unix(), id)
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	return nil
+}
+
 func (d *Database) BeginTx() (DatabaseTx, error) {
 	var tx DatabaseTx
 	var err error
 	tx.tx, err = d.conn.Begin()
+	tx.compression = d.compression
 	return tx, err
 }
 
@@ -115,6 +1031,10 @@ func (tx *DatabaseTx) Commit() error {
 	return tx.tx.Commit()
 }
 
+func (tx *DatabaseTx) Rollback() error {
+	return tx.tx.Rollback()
+}
+
 func (tx *DatabaseTx) InsertMessage(messageJSON *gjson.Result) error {
 	messageID := messageJSON.Get("message_id").Int()
 	messageThreadID := messageJSON.Get("message_thread_id")
@@ -123,10 +1043,19 @@ func (tx *DatabaseTx) InsertMessage(messageJSON *gjson.Result) error {
 		Valid: messageThreadID.Exists(),
 	}
 	chatID := messageJSON.Get("chat.id").Int()
-	log.Println("Inserting message:", messageJSON)
-	_, err := tx.tx.Exec(
-		"INSERT OR REPLACE INTO messages (message_id, message_thread_id, chat_id, message) VALUES (?, ?, ?, jsonb(?));",
-		messageID, messageThreadIDSQL, chatID, messageJSON.Raw,
+	businessConnectionID := messageJSON.Get("business_connection_id")
+	businessConnectionIDSQL := sql.NullString{
+		String: businessConnectionID.String(),
+		Valid:  businessConnectionID.Exists(),
+	}
+	slog.Debug("Inserting message", "chat_id", chatID, "message_id", messageID, "message", messageJSON.Raw)
+	message, placeholder, err := compressJSON(messageJSON.Raw, tx.compression)
+	if err != nil {
+		return err
+	}
+	_, err = tx.tx.Exec(
+		"INSERT OR REPLACE INTO messages (message_id, message_thread_id, chat_id, business_connection_id, message, compression, created_at) VALUES (?, ?, ?, ?, "+placeholder+", ?, unixepoch());",
+		messageID, messageThreadIDSQL, chatID, businessConnectionIDSQL, message, tx.compression,
 	)
 	if err != nil {
 		return fmt.Errorf("database error: %v", err)
@@ -134,11 +1063,15 @@ func (tx *DatabaseTx) InsertMessage(messageJSON *gjson.Result) error {
 	return nil
 }
 
-func (tx *DatabaseTx) InsertUpdate(upstreamID uint64, updateType string, updateValue string) error {
-	log.Printf("Inserting update %d: {\"%s\":%s}\n", upstreamID, updateType, updateValue)
+func (tx *DatabaseTx) InsertDeletion(messageJSON *gjson.Result, deleteAt time.Time) error {
+	businessConnectionID := messageJSON.Get("business_connection_id")
+	businessConnectionIDSQL := sql.NullString{
+		String: businessConnectionID.String(),
+		Valid:  businessConnectionID.Exists(),
+	}
 	_, err := tx.tx.Exec(
-		"INSERT OR REPLACE INTO updates (upstream_id, type, \"update\") VALUES (?, ?, jsonb(?));",
-		upstreamID, updateType, updateValue,
+		"INSERT INTO deletions (chat_id, message_id, business_connection_id, delete_at) VALUES (?, ?, ?, ?);",
+		messageJSON.Get("chat.id").Int(), messageJSON.Get("message_id").Int(), businessConnectionIDSQL, deleteAt.Unix(),
 	)
 	if err != nil {
 		return fmt.Errorf("database error: %v", err)
@@ -146,11 +1079,11 @@ func (tx *DatabaseTx) InsertUpdate(upstreamID uint64, updateType string, updateV
 	return nil
 }
 
-func (tx *DatabaseTx) InsertLocalUpdate(updateType string, updateValue string) error {
-	log.Printf("Inserting local update: {\"%s\":%s}\n", updateType, updateValue)
+// SaveOffset saves the offset into upstream's updates, in the same transaction as the updates below it.
+func (tx *DatabaseTx) SaveOffset(offset uint64, botID int64) error {
 	_, err := tx.tx.Exec(
-		"INSERT OR REPLACE INTO updates (type, \"update\") VALUES (?, jsonb(?));",
-		updateType, updateValue,
+		"INSERT INTO state (key, value) VALUES ('upstream_offset', ?), ('upstream_bot_id', ?), ('upstream_offset_time', unixepoch()) ON CONFLICT (key) DO UPDATE SET value = excluded.value;",
+		offset, botID,
 	)
 	if err != nil {
 		return fmt.Errorf("database error: %v", err)
@@ -158,14 +1091,101 @@ func (tx *DatabaseTx) InsertLocalUpdate(updateType string, updateValue string) e
 	return nil
 }
 
-func (tx *DatabaseTx) InsertLocalUpdateByID(messageID int64, chatID int64) error {
-	fmt.Println("Inserting update by message ID", messageID, chatID)
-	_, err := tx.tx.Exec(
-		"INSERT OR REPLACE INTO updates (type, \"update\") SELECT ('message', message) FROM messages WHERE message_id = ? AND chat_id = ?;",
-		messageID, chatID,
+// HasUpdate reports whether an update from upstream is stored already, because upstream delivered it again.
+func (tx *DatabaseTx) HasUpdate(upstreamID uint64) (bool, error) {
+	var exists bool
+	err := tx.tx.QueryRow("SELECT EXISTS (SELECT 1 FROM updates WHERE upstream_id = ?);", upstreamID).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("database error: %v", err)
+	}
+	return exists, nil
+}
+
+// InsertUpdate stores an update from upstream, unless one with the same update_id is stored already.
+// Replacing it would give it a new id, which consumers that have read it already would see as a new update.
+func (tx *DatabaseTx) InsertUpdate(upstreamID uint64, updateType string, updateValue string) error {
+	slog.Debug("Inserting update", "update_id", upstreamID, "type", updateType, "update", updateValue)
+	update, placeholder, err := compressJSON(updateValue, tx.compression)
+	if err != nil {
+		return err
+	}
+	_, err = tx.tx.Exec(
+		"INSERT INTO updates (upstream_id, type, \"update\", compression, chat_id, created_at) VALUES (?, ?, "+placeholder+", ?, ?, unixepoch()) ON CONFLICT (upstream_id) DO NOTHING;",
+		upstreamID, updateType, update, tx.compression, updateChatID(updateValue),
 	)
 	if err != nil {
 		return fmt.Errorf("database error: %v", err)
 	}
 	return nil
 }
+
+func (tx *DatabaseTx) InsertLocalUpdate(updateType string, updateValue string) error {
+	slog.Debug("Inserting local update", "type", updateType, "update", updateValue)
+	update, placeholder, err := compressJSON(updateValue, tx.compression)
+	if err != nil {
+		return err
+	}
+	_, err = tx.tx.Exec(
+		"INSERT OR REPLACE INTO updates (type, \"update\", compression, chat_id, created_at) VALUES (?, "+placeholder+", ?, ?, unixepoch());",
+		updateType, update, tx.compression, updateChatID(updateValue),
+	)
+	if err != nil {
+		return fmt.Errorf("database error: %v", err)
+	}
+	return nil
+}
+
+// updateChatID finds the chat an update belongs to, which is where callback queries keep it too, or nil if it has none.
+func updateChatID(updateValue string) any {
+	chatID := gjson.Get(updateValue, "chat.id")
+	if !chatID.Exists() {
+		chatID = gjson.Get(updateValue, "message.chat.id")
+	}
+	if chatID.Type != gjson.Number {
+		return nil
+	}
+	return chatID.Int()
+}
+
+// compressJSON returns the value to bind and the SQL placeholder expression for it.
+func compressJSON(raw string, compression int) (any, string, error) {
+	switch compression {
+	case dbCompressionNone:
+		return raw, "jsonb(?)", nil
+	case dbCompressionGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		_, err := io.WriteString(w, raw)
+		if err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("compression error: %v", err)
+		}
+		return buf.Bytes(), "?", nil
+	}
+	return nil, "", fmt.Errorf("unsupported compression %d", compression)
+}
+
+// dbSelectJSON selects a column holding JSON that may be compressed, to be decoded by decompressJSON.
+func dbSelectJSON(column string) string {
+	return fmt.Sprintf("CASE compression WHEN %d THEN json(%s) ELSE %s END", dbCompressionNone, column, column)
+}
+
+func decompressJSON(buf []byte, compression int) (string, error) {
+	switch compression {
+	case dbCompressionNone:
+		return string(buf), nil
+	case dbCompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(buf))
+		if err != nil {
+			return "", fmt.Errorf("decompression error: %v", err)
+		}
+		raw, err := io.ReadAll(r)
+		if err != nil {
+			return "", fmt.Errorf("decompression error: %v", err)
+		}
+		return string(raw), nil
+	}
+	return "", fmt.Errorf("unsupported compression %d, was the database written by a newer version?", compression)
+}
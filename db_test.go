@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// benchmarkUpdate is a message with enough text for db_compression to make a difference.
+var benchmarkUpdate = fmt.Sprintf(`{"message_id":1,"from":{"id":1,"is_bot":false,"first_name":"User"},"chat":{"id":5,"type":"private","first_name":"User"},"date":1700000000,"text":%s}`,
+	JSONQuote(strings.Repeat("The quick brown fox jumps over the lazy dog. ", 40)))
+
+// benchmarkDatabase opens a fresh database storing updates with the given db_compression.
+func benchmarkDatabase(b *testing.B, compression string) *Database {
+	b.Helper()
+	db, err := OpenDatabase(testConfig(b, "", fmt.Sprintf("db_compression = %q", compression)))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { db.Close() })
+	return db
+}
+
+// insertUpdates stores n copies of benchmarkUpdate in one transaction.
+func insertUpdates(b *testing.B, db *Database, n int) {
+	b.Helper()
+	tx, err := db.BeginTx()
+	if err != nil {
+		b.Fatal(err)
+	}
+	for range n {
+		err = tx.InsertLocalUpdate("message", benchmarkUpdate)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkStoreUpdates(b *testing.B) {
+	for _, compression := range []string{"none", "gzip"} {
+		b.Run(compression, func(b *testing.B) {
+			db := benchmarkDatabase(b, compression)
+			b.SetBytes(int64(len(benchmarkUpdate)))
+			for b.Loop() {
+				insertUpdates(b, db, 1)
+			}
+			b.StopTimer()
+			// Move everything out of the write-ahead log, which Stats does not count
+			_, err := db.conn.Exec("PRAGMA wal_checkpoint(TRUNCATE);")
+			if err != nil {
+				b.Fatal(err)
+			}
+			stats, err := db.Stats(context.Background())
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportMetric(float64(stats.Size)/float64(stats.Updates), "db-bytes/update")
+		})
+	}
+}
+
+func BenchmarkReadUpdates(b *testing.B) {
+	for _, compression := range []string{"none", "gzip"} {
+		b.Run(compression, func(b *testing.B) {
+			db := benchmarkDatabase(b, compression)
+			insertUpdates(b, db, 100)
+			b.SetBytes(100 * int64(len(benchmarkUpdate)))
+			for b.Loop() {
+				for _, err := range db.GetUpdates(context.Background(), "default", 1, 100, nil) {
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// deletionRetryInterval is how long a deletion waits after a transient failure before being tried again,
+// and how long the deleter pauses after a database error.
+const deletionRetryInterval = time.Minute
+
+// StartDeleting deletes messages sent with an X-Muxer-Delete-After header once they are due.
+// Pending deletions live in the database, so those due during downtime are carried out right after a restart.
+// A deletion that fails because of the network, a 5xx or a 429 is retried later. Any other error, such as the
+// message already being gone or too old to delete, is logged and the deletion is dropped.
+func (c *Client) StartDeleting(ctx context.Context) {
+	failed := false
+	for {
+		// After a database error the same deletions are still due, so going right back would spin as long as it lasts
+		if failed {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(deletionRetryInterval):
+			}
+			failed = false
+		}
+		deleteAt, ok, err := c.db.NextDeletionTime(ctx)
+		if err != nil {
+			slog.Error("Failed to load pending deletions", "err", err)
+			deleteAt, ok = time.Now().Add(deletionRetryInterval), true
+		}
+		var timer <-chan time.Time
+		if ok {
+			timer = time.After(time.Until(deleteAt))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.deleterWake:
+			continue
+		case <-timer:
+		}
+
+		deletions, err := c.db.DueDeletions(ctx, time.Now())
+		if err != nil {
+			slog.Error("Failed to load pending deletions", "err", err)
+			failed = true
+			continue
+		}
+		for _, del := range deletions {
+			retry, err := c.deleteMessage(ctx, &del)
+			if ctx.Err() != nil {
+				return
+			}
+			if err == nil || !retry {
+				if err != nil {
+					slog.Warn("Failed to delete message", "chat_id", del.ChatID, "message_id", del.MessageID, "err", err)
+				}
+				err = c.db.RemoveDeletion(del.ID)
+			} else {
+				slog.Warn("Failed to delete message, will retry", "chat_id", del.ChatID, "message_id", del.MessageID, "err", err)
+				err = c.db.PostponeDeletion(del.ID, time.Now().Add(deletionRetryInterval))
+			}
+			if err != nil {
+				slog.Error("Failed to update pending deletions", "err", err)
+				failed = true
+			}
+		}
+	}
+}
+
+func (c *Client) wakeDeleter() {
+	select {
+	case c.deleterWake <- struct{}{}:
+	default:
+	}
+}
+
+// deleteMessage calls deleteMessage upstream after waiting for the chat's cooldown, like a forwarded request would.
+func (c *Client) deleteMessage(ctx context.Context, del *PendingDeletion) (bool, error) {
+	sleep := c.cooldownRemaining(del.ChatID)
+	if sleep > 0 {
+		select {
+		case <-ctx.Done():
+			return true, ctx.Err()
+		case <-time.After(sleep):
+		}
+	}
+
+	query := url.Values{}
+	query.Set("chat_id", fmt.Sprint(del.ChatID))
+	query.Set("message_id", fmt.Sprint(del.MessageID))
+	if del.BusinessConnectionID.Valid {
+		query.Set("business_connection_id", del.BusinessConnectionID.String)
+	}
+	requestURL := c.config().Upstream.ApiURL("deleteMessage", query.Encode())
+	slog.Debug("Deleting message", "url", requestURL)
+	ctx, cancel := c.requestContext(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to send HTTP request: %v", err)
+	}
+	req.Header.Set("User-Agent", c.config().Upstream.UserAgentHeader())
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("upstream HTTP request error: %v", err)
+	}
+	defer drainAndClose(resp.Body)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return true, fmt.Errorf("HTTP read error: %v", err)
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		c.onRateLimited(del.ChatID, retryAfter(resp.Header, body))
+	}
+	bodyJson := gjson.ParseBytes(body)
+	if bodyJson.Get("ok").Type != gjson.True {
+		retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return retry, fmt.Errorf("upstream error: %s %s", bodyJson.Get("error_code").String(), bodyJson.Get("description").String())
+	}
+	err = c.db.MarkMessageDeleted(del.ChatID, del.MessageID, del.BusinessConnectionID)
+	if err != nil {
+		slog.Error("Failed to store updates", "method", "deleteMessage", "chat_id", del.ChatID, "err", err)
+	}
+	return false, nil
+}
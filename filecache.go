@@ -0,0 +1,218 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileCache keeps downloaded files on disk, evicting the least recently used ones once MaxSize is exceeded.
+// Telegram never changes the content behind a file_path, so a cached file stays valid until it is evicted.
+type FileCache struct {
+	dir     string
+	maxSize uint64
+	mutex   *sync.Mutex
+	size    uint64
+	lru     *list.List
+	entries map[string]*list.Element
+	pending map[string]*fileCacheDownload
+}
+
+type fileCacheEntry struct {
+	name string
+	size uint64
+}
+
+type fileCacheDownload struct {
+	done chan struct{}
+	err  error
+}
+
+// errFileNotCacheable is returned by a fetch function when the response should be forwarded as-is instead.
+var errFileNotCacheable = errors.New("file is not cacheable")
+
+func OpenFileCache(conf *ConfigFileCache) (*FileCache, error) {
+	if len(conf.Dir) == 0 {
+		return nil, nil
+	}
+	err := os.MkdirAll(conf.Dir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file cache: %v", err)
+	}
+	dirEntries, err := os.ReadDir(conf.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file cache: %v", err)
+	}
+
+	type existingFile struct {
+		name    string
+		size    uint64
+		modTime time.Time
+	}
+	existingFiles := make([]existingFile, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.Type().IsRegular() {
+			continue
+		}
+		if strings.HasSuffix(dirEntry.Name(), ".tmp") {
+			// Left over from an interrupted download
+			os.Remove(filepath.Join(conf.Dir, dirEntry.Name()))
+			continue
+		}
+		info, err := dirEntry.Info()
+		if err != nil {
+			continue
+		}
+		existingFiles = append(existingFiles, existingFile{
+			name:    dirEntry.Name(),
+			size:    uint64(info.Size()),
+			modTime: info.ModTime(),
+		})
+	}
+	slices.SortFunc(existingFiles, func(a, b existingFile) int {
+		return b.modTime.Compare(a.modTime)
+	})
+
+	fc := &FileCache{
+		dir:     conf.Dir,
+		maxSize: conf.MaxSize,
+		mutex:   new(sync.Mutex),
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		pending: make(map[string]*fileCacheDownload),
+	}
+	for _, f := range existingFiles {
+		fc.entries[f.name] = fc.lru.PushBack(&fileCacheEntry{name: f.name, size: f.size})
+		fc.size += f.size
+	}
+	fc.mutex.Lock()
+	fc.evict()
+	fc.mutex.Unlock()
+	slog.Info("File cache loaded", "dir", fc.dir, "files", fc.lru.Len(), "size", fc.size)
+	return fc, nil
+}
+
+// Open returns the cached file for filePath, calling fetch to download it on a miss.
+// Concurrent misses on the same filePath share a single download.
+func (fc *FileCache) Open(ctx context.Context, filePath string, fetch func(io.Writer) error) (*os.File, error) {
+	sum := sha256.Sum256([]byte(filePath))
+	name := hex.EncodeToString(sum[:])
+
+	for {
+		fc.mutex.Lock()
+		if elem, ok := fc.entries[name]; ok {
+			fc.lru.MoveToFront(elem)
+			fc.mutex.Unlock()
+			f, err := os.Open(filepath.Join(fc.dir, name))
+			if err == nil {
+				now := time.Now()
+				os.Chtimes(f.Name(), now, now)
+				return f, nil
+			}
+			// Someone removed the file behind our back, forget it and download again
+			fc.mutex.Lock()
+			if elem, ok := fc.entries[name]; ok {
+				fc.remove(elem)
+			}
+			fc.mutex.Unlock()
+			continue
+		}
+		if download, ok := fc.pending[name]; ok {
+			fc.mutex.Unlock()
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-download.done:
+			}
+			if errors.Is(download.err, context.Canceled) && ctx.Err() == nil {
+				// The consumer that started the download went away, but we are still here
+				continue
+			}
+			if download.err != nil {
+				return nil, download.err
+			}
+			continue
+		}
+		download := &fileCacheDownload{done: make(chan struct{})}
+		fc.pending[name] = download
+		fc.mutex.Unlock()
+
+		var f *os.File
+		f, download.err = fc.download(name, fetch)
+		fc.mutex.Lock()
+		delete(fc.pending, name)
+		fc.mutex.Unlock()
+		close(download.done)
+		return f, download.err
+	}
+}
+
+// download returns the downloaded file already open, so it can be read even if it is evicted right away.
+func (fc *FileCache) download(name string, fetch func(io.Writer) error) (*os.File, error) {
+	tmp, err := os.CreateTemp(fc.dir, name+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("file cache error: %v", err)
+	}
+	err = fetch(tmp)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	info, err := os.Stat(tmp.Name())
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("file cache error: %v", err)
+	}
+	err = os.Rename(tmp.Name(), filepath.Join(fc.dir, name))
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("file cache error: %v", err)
+	}
+	f, err := os.Open(filepath.Join(fc.dir, name))
+	if err != nil {
+		os.Remove(filepath.Join(fc.dir, name))
+		return nil, fmt.Errorf("file cache error: %v", err)
+	}
+
+	fc.mutex.Lock()
+	fc.entries[name] = fc.lru.PushFront(&fileCacheEntry{name: name, size: uint64(info.Size())})
+	fc.size += uint64(info.Size())
+	fc.evict()
+	fc.mutex.Unlock()
+	return f, nil
+}
+
+// evict must be called with mutex held.
+// A file larger than maxSize is evicted right after its download, but the caller that downloaded it has it open already.
+func (fc *FileCache) evict() {
+	for fc.size > fc.maxSize && fc.lru.Len() != 0 {
+		fc.remove(fc.lru.Back())
+	}
+}
+
+// remove must be called with mutex held.
+func (fc *FileCache) remove(elem *list.Element) {
+	entry := fc.lru.Remove(elem).(*fileCacheEntry)
+	delete(fc.entries, entry.name)
+	fc.size -= entry.size
+	err := os.Remove(filepath.Join(fc.dir, entry.name))
+	if err != nil && !os.IsNotExist(err) {
+		slog.Error("File cache error", "err", err)
+	}
+}
@@ -3,27 +3,90 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/BurntSushi/toml"
 )
 
 func main() {
-	confPath := flag.String("conf", "tbmux.conf", "Configuration file")
+	confPath := flag.String("conf", "tbmux.conf", "Configuration file, or a directory of *.conf files")
+	printRoutes := flag.Bool("print-routes", false, "Print the resolved upstream URLs and downstream path segments, then exit")
+	check := flag.Bool("check", false, "Check the config without opening the database or the network, print it with defaults filled in, then exit")
+	rebuildCache := flag.Bool("rebuild-cache", false, "Rebuild the message cache from stored updates, then exit")
+	replay := flag.String("replay", "", "Re-send a recorded request to the configured upstream, then exit")
 	flag.Parse()
 
 	conf, err := Load(*confPath)
 	if err != nil {
 		log.Fatalln(err)
 	}
+	slog.SetDefault(slog.New(NewLogHandler(&conf.Downstream)))
+	if *printRoutes {
+		PrintRoutes(conf)
+		return
+	}
+	if *check {
+		err = CheckConfig(conf)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	if len(*replay) != 0 {
+		err = Replay(conf, *replay)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
 	db, err := OpenDatabase(conf)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	c := NewClient(conf, db)
+	fc, err := OpenFileCache(&conf.Upstream.FileCache)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	c := NewClient(conf, db, fc)
+	if *rebuildCache {
+		err = c.RebuildMessageCache(context.Background())
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
 	s, err := NewServer(conf, db, c)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
+	ctx, stop := context.WithCancel(context.Background())
+	shutdown := make(chan struct{})
+	go handleSignals(shutdown)
+	go handleReload(*confPath, c, s)
+
+	go db.StartPruning(ctx, &conf.Retention)
+	if conf.Database.MaintenanceInterval != 0 {
+		go db.StartMaintaining(ctx, &conf.Database)
+	}
+	if len(conf.Downstream.MetricsPath) != 0 && conf.Database.StatsInterval != 0 {
+		go c.metrics.StartSampling(ctx, db, &conf.Database)
+	}
+	err = s.StartPushing(ctx)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	go c.StartDeleting(ctx)
+	go c.StartSweeping(ctx)
+
 	go func() {
 		err := s.Serve()
 		if err != nil {
@@ -31,6 +94,132 @@ func main() {
 		}
 	}()
 
-	err = c.StartPolling(context.Background())
-	log.Fatalln(err)
+	pollCtx, stopPolling := context.WithCancel(context.Background())
+	pollDone := make(chan error, 1)
+	go func() {
+		if len(conf.Upstream.Webhook.URL) != 0 {
+			pollDone <- c.StartWebhook(pollCtx)
+		} else {
+			pollDone <- c.StartPolling(pollCtx)
+		}
+	}()
+	select {
+	case err = <-pollDone:
+		log.Fatalln(err)
+	case <-shutdown:
+	}
+	stop()
+
+	// Stopping the poller aborts a poll still waiting for updates, but a poll that already returned is
+	// stored and confirmed upstream first, so no update is lost either way. Both steps share one deadline,
+	// after which remaining forwards are cut off.
+	drainCtx, cancel := context.WithTimeout(context.Background(), time.Duration(conf.Shutdown.DrainTimeout)*time.Second)
+	defer cancel()
+	finishPolling := func() {
+		stopPolling()
+		select {
+		case err := <-pollDone:
+			if err != nil {
+				slog.Error("Polling stopped with an error", "err", err)
+			}
+		case <-drainCtx.Done():
+			slog.Warn("Timed out waiting for the poller to stop")
+		}
+	}
+	drainForwards := func() {
+		err := s.Shutdown(drainCtx)
+		if err != nil {
+			slog.Warn("Failed to drain downstream requests", "err", err)
+			s.Close()
+		}
+	}
+	if conf.Shutdown.Order == "forwards_first" {
+		drainForwards()
+		finishPolling()
+	} else {
+		finishPolling()
+		drainForwards()
+	}
+
+	err = db.Close()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	slog.Info("Shutdown complete")
+}
+
+// handleSignals starts a graceful shutdown on the first SIGINT or SIGTERM, and exits immediately on the second.
+func handleSignals(shutdown chan<- struct{}) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	slog.Info("Shutting down, send again to exit immediately", "signal", sig)
+	close(shutdown)
+	sig = <-signals
+	slog.Info("Exiting immediately", "signal", sig)
+	os.Exit(1)
+}
+
+// handleReload reloads the config and the TLS certificate on SIGHUP, keeping the current config if the new one is invalid.
+func handleReload(confPath string, c *Client, s *Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		slog.Info("Received SIGHUP, reloading config")
+		err := s.ReloadCertificate()
+		if err != nil {
+			slog.Warn("Keeping the current TLS certificate", "err", err)
+		}
+		conf, err := Load(confPath)
+		if err != nil {
+			slog.Error("Config reload failed, keeping the current config", "err", err)
+			continue
+		}
+		c.Reload(conf)
+	}
+}
+
+// CheckConfig prints a config that Load accepted, with defaults filled in and secrets redacted, followed by what Load derived from it.
+func CheckConfig(conf *Config) error {
+	redacted := *conf
+	redacted.Upstream.AuthToken = "<redacted>"
+	redacted.Upstream.Webhook.SecretToken = "<redacted>"
+	redacted.Downstream.AuthToken = "<redacted>"
+	if conf.Upstream.ProxyURL != nil {
+		redacted.Upstream.Proxy = conf.Upstream.ProxyURL.Redacted()
+	}
+	err := toml.NewEncoder(os.Stdout).Encode(&redacted)
+	if err != nil {
+		return fmt.Errorf("failed to print config: %v", err)
+	}
+	fmt.Println()
+	PrintRoutes(conf)
+	filter, _ := url.QueryUnescape(conf.Upstream.FilterUpdateTypesStr)
+	fmt.Println("Upstream allowed_updates:", filter)
+	if len(conf.Downstream.AllowedPrefixes) != 0 {
+		fmt.Println("Downstream allowed ranges:", conf.Downstream.AllowedPrefixes)
+	}
+	fmt.Println("Config is valid")
+	return nil
+}
+
+func PrintRoutes(conf *Config) {
+	redact := func(s string) string {
+		return strings.ReplaceAll(s, url.PathEscape(conf.Upstream.AuthToken), "<upstream.auth_token>")
+	}
+	fmt.Println("Upstream API URL: ", redact(conf.Upstream.ApiURL("<method>", "")))
+	fmt.Println("Upstream file URL:", redact(conf.Upstream.FileURL("<file_path>", "")))
+	printSegments := func(name string, segments []string) {
+		fmt.Printf("Downstream %s path segments:\n", name)
+		for i, seg := range segments {
+			if i == len(segments)-1 {
+				fmt.Printf("  [%d] %q + <downstream.auth_token>\n", i, seg)
+			} else {
+				fmt.Printf("  [%d] %q\n", i, seg)
+			}
+		}
+		fmt.Printf("  [%d] <%s>\n", len(segments), name)
+	}
+	printSegments("method", conf.Downstream.ApiPrefix)
+	printSegments("file_path", conf.Downstream.FilePrefix)
 }
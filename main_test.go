@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testConfig loads a config with a fresh database in a temporary directory, talking to upstreamURL
+// instead of Telegram. settings are extra lines of the config file, such as "downstream.keep_alive = false".
+func testConfig(tb testing.TB, upstreamURL string, settings ...string) *Config {
+	tb.Helper()
+	conf, err := Load(writeTestConfig(tb, upstreamURL, settings...))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return conf
+}
+
+// writeTestConfig writes the config file testConfig loads, and returns its path.
+func writeTestConfig(tb testing.TB, upstreamURL string, settings ...string) string {
+	tb.Helper()
+	if upstreamURL == "" {
+		// Nothing listens there, for tests that never reach upstream
+		upstreamURL = "http://127.0.0.1:1"
+	}
+	dir := tb.TempDir()
+	lines := append([]string{
+		fmt.Sprintf("db = %q", filepath.Join(dir, "tbmux.db")),
+		`upstream.auth_token = "1:abc"`,
+		fmt.Sprintf("upstream.api_url = %q", upstreamURL+"/bot"),
+		fmt.Sprintf("upstream.file_url = %q", upstreamURL+"/file/bot"),
+		`downstream.auth_token = "x"`,
+		`downstream.listen_addr = "127.0.0.1:0"`,
+	}, settings...)
+	path := filepath.Join(dir, "tbmux.conf")
+	err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return path
+}
+
+// testClient opens the database of conf and returns a Client using it, without polling.
+func testClient(tb testing.TB, conf *Config) *Client {
+	tb.Helper()
+	db, err := OpenDatabase(conf)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { db.Close() })
+	return NewClient(conf, db, nil)
+}
+
+// testServer starts serving conf on a random port, and returns the URL Bot API methods are called under.
+func testServer(tb testing.TB, conf *Config) (*Server, string) {
+	tb.Helper()
+	c := testClient(tb, conf)
+	s, err := NewServer(conf, c.db, c)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	go s.Serve()
+	tb.Cleanup(func() { s.Close() })
+	return s, "http://" + s.listener.Addr().String() + "/botx/"
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// KnownMethods lists the methods of Bot API 8.3, append to it when Telegram adds new ones.
+// Only these get a label of their own in tbmux_forwarded_requests_total.
+var KnownMethods = []string{
+	"getUpdates", "setWebhook", "deleteWebhook", "getWebhookInfo",
+	"getMe", "logOut", "close",
+	"sendMessage", "forwardMessage", "forwardMessages", "copyMessage", "copyMessages",
+	"sendPhoto", "sendAudio", "sendDocument", "sendVideo", "sendAnimation", "sendVoice", "sendVideoNote", "sendPaidMedia",
+	"sendMediaGroup", "sendLocation", "sendVenue", "sendContact", "sendPoll", "sendDice", "sendChatAction",
+	"setMessageReaction", "getUserProfilePhotos", "setUserEmojiStatus", "getFile",
+	"banChatMember", "unbanChatMember", "restrictChatMember", "promoteChatMember", "setChatAdministratorCustomTitle",
+	"banChatSenderChat", "unbanChatSenderChat", "setChatPermissions",
+	"exportChatInviteLink", "createChatInviteLink", "editChatInviteLink", "createChatSubscriptionInviteLink",
+	"editChatSubscriptionInviteLink", "revokeChatInviteLink", "approveChatJoinRequest", "declineChatJoinRequest",
+	"setChatPhoto", "deleteChatPhoto", "setChatTitle", "setChatDescription",
+	"pinChatMessage", "unpinChatMessage", "unpinAllChatMessages", "leaveChat",
+	"getChat", "getChatAdministrators", "getChatMemberCount", "getChatMember", "setChatStickerSet", "deleteChatStickerSet",
+	"getForumTopicIconStickers", "createForumTopic", "editForumTopic", "closeForumTopic", "reopenForumTopic",
+	"deleteForumTopic", "unpinAllForumTopicMessages", "editGeneralForumTopic", "closeGeneralForumTopic",
+	"reopenGeneralForumTopic", "hideGeneralForumTopic", "unhideGeneralForumTopic", "unpinAllGeneralForumTopicMessages",
+	"answerCallbackQuery", "getUserChatBoosts", "getBusinessConnection",
+	"setMyCommands", "deleteMyCommands", "getMyCommands", "setMyName", "getMyName",
+	"setMyDescription", "getMyDescription", "setMyShortDescription", "getMyShortDescription",
+	"setChatMenuButton", "getChatMenuButton", "setMyDefaultAdministratorRights", "getMyDefaultAdministratorRights",
+	"editMessageText", "editMessageCaption", "editMessageMedia", "editMessageLiveLocation", "stopMessageLiveLocation",
+	"editMessageReplyMarkup", "stopPoll", "deleteMessage", "deleteMessages",
+	"sendSticker", "getStickerSet", "getCustomEmojiStickers", "uploadStickerFile", "createNewStickerSet",
+	"addStickerToSet", "setStickerPositionInSet", "deleteStickerFromSet", "replaceStickerInSet", "setStickerEmojiList",
+	"setStickerKeywords", "setStickerMaskPosition", "setStickerSetTitle", "setStickerSetThumbnail",
+	"setCustomEmojiStickerSetThumbnail", "deleteStickerSet",
+	"getAvailableGifts", "sendGift", "verifyUser", "verifyChat", "removeUserVerification", "removeChatVerification",
+	"answerInlineQuery", "answerWebAppQuery", "savePreparedInlineMessage",
+	"sendInvoice", "createInvoiceLink", "answerShippingQuery", "answerPreCheckoutQuery",
+	"getStarTransactions", "refundStarPayment", "editUserStarSubscription",
+	"setPassportDataErrors", "sendGame", "setGameScore", "getGameHighScores",
+}
+
+// methodLabel returns the label of a forwarded method in tbmux_forwarded_requests_total. Anything not in KnownMethods
+// is counted as "(other)", since the method comes from the consumer and each label value creates a series that stays forever.
+func methodLabel(method string) string {
+	i := slices.IndexFunc(KnownMethods, func(known string) bool {
+		// Like Telegram, methods are matched ignoring case
+		return strings.EqualFold(known, method)
+	})
+	if i < 0 {
+		return "(other)"
+	}
+	return KnownMethods[i]
+}
+
+// Metrics holds the Prometheus collectors, registered on a registry of our own instead of the global one.
+type Metrics struct {
+	registry          *prometheus.Registry
+	updatesReceived   prometheus.Counter
+	forwardedRequests *prometheus.CounterVec
+	echoMessages      prometheus.Counter
+	retryInterval     prometheus.Gauge
+	storeDuration     prometheus.Gauge
+	dbMessages        prometheus.Gauge
+	dbUpdates         prometheus.Gauge
+	dbUndelivered     *prometheus.GaugeVec
+	dbSize            prometheus.Gauge
+}
+
+func NewMetrics(c *Client) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		updatesReceived: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "tbmux_updates_received_total",
+			Help: "Updates received from upstream, by polling or by webhook.",
+		}),
+		forwardedRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tbmux_forwarded_requests_total",
+			Help: "Requests forwarded to upstream, by Bot API method, \"(other)\" for unknown methods, or \"(file)\" for file downloads.",
+		}, []string{"method"}),
+		echoMessages: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "tbmux_echo_messages_total",
+			Help: "Responses to sent or edited messages processed into local updates.",
+		}),
+		retryInterval: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "tbmux_retry_interval_seconds",
+			Help: "How long the next failed poll waits before retrying, which grows while upstream keeps failing.",
+		}),
+		storeDuration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "tbmux_store_duration_seconds",
+			Help: "How long storing the updates of the last poll took, up to and including the commit.",
+		}),
+		dbMessages: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "tbmux_db_messages",
+			Help: "Messages cached in the database, counting each stored edit, sampled every database.stats_interval.",
+		}),
+		dbUpdates: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "tbmux_db_updates",
+			Help: "Updates stored in the database, sampled every database.stats_interval.",
+		}),
+		dbUndelivered: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "tbmux_db_undelivered_updates",
+			Help: "Updates a consumer has not confirmed yet, by consumer name, \"default\" for the bare token, sampled every database.stats_interval.",
+		}, []string{"consumer"}),
+		dbSize: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "tbmux_db_size_bytes",
+			Help: "Size of the database file, not counting the write-ahead log, sampled every database.stats_interval.",
+		}),
+	}
+	chatCooldowns := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "tbmux_chat_cooldowns",
+		Help: "Chats with a send cooldown being tracked.",
+	}, func() float64 {
+		c.cooldownMutex.RLock()
+		defer c.cooldownMutex.RUnlock()
+		return float64(len(c.chatCooldown))
+	})
+	m.registry.MustRegister(
+		m.updatesReceived,
+		m.forwardedRequests,
+		m.echoMessages,
+		m.retryInterval,
+		m.storeDuration,
+		m.dbMessages,
+		m.dbUpdates,
+		m.dbUndelivered,
+		m.dbSize,
+		chatCooldowns,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// StartSampling updates the database gauges every database.stats_interval seconds, starting right away.
+// Counting rows is too slow to do on every scrape of a large database.
+func (m *Metrics) StartSampling(ctx context.Context, db *Database, conf *ConfigDatabase) {
+	interval := time.Duration(conf.StatsInterval) * time.Second
+	for {
+		stats, err := db.Stats(ctx)
+		if err == nil {
+			m.dbMessages.Set(float64(stats.Messages))
+			m.dbUpdates.Set(float64(stats.Updates))
+			m.dbSize.Set(float64(stats.Size))
+			// Start over, so consumers removed from the database disappear from the metrics
+			m.dbUndelivered.Reset()
+			for consumerID, count := range stats.Undelivered {
+				m.dbUndelivered.WithLabelValues(consumerID).Set(float64(count))
+			}
+		} else if ctx.Err() == nil {
+			slog.Warn("Failed to sample database stats", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
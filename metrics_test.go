@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestMethodLabel(t *testing.T) {
+	tests := []struct {
+		method string
+		want   string
+	}{
+		{"sendMessage", "sendMessage"},
+		{"SENDMESSAGE", "sendMessage"},
+		{"sendMesage", "(other)"},
+		{"foo1", "(other)"},
+	}
+	for _, tt := range tests {
+		if got := methodLabel(tt.method); got != tt.want {
+			t.Errorf("methodLabel(%q) = %q, want %q", tt.method, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// pushMaxRetryInterval caps the delay between failed deliveries to a consumer's webhook.
+const pushMaxRetryInterval = 5 * time.Minute
+
+// pusher delivers one consumer's updates to the webhook it set with setWebhook.
+type pusher struct {
+	hook             ConsumerWebhook
+	cancel           context.CancelFunc
+	done             chan struct{}
+	errorMutex       *sync.Mutex
+	lastErrorDate    int64
+	lastErrorMessage string
+}
+
+// StartPushing starts delivering updates to the webhooks consumers have set, until ctx is done.
+// Webhooks set later with setWebhook are started right away.
+func (s *Server) StartPushing(ctx context.Context) error {
+	s.pushMutex.Lock()
+	defer s.pushMutex.Unlock()
+	hooks, err := s.db.Webhooks(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load webhooks: %v", err)
+	}
+	s.pushCtx = ctx
+	for _, hook := range hooks {
+		s.startPusher(hook)
+	}
+	return nil
+}
+
+// startPusher replaces the consumer's running pusher, if any. pushMutex must be held.
+func (s *Server) startPusher(hook ConsumerWebhook) {
+	s.stopPusher(hook.ConsumerID)
+	if s.pushCtx == nil {
+		// StartPushing loads it from the database
+		return
+	}
+	ctx, cancel := context.WithCancel(s.pushCtx)
+	p := &pusher{
+		hook:       hook,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+		errorMutex: new(sync.Mutex),
+	}
+	s.pushers[hook.ConsumerID] = p
+	go s.push(ctx, p)
+}
+
+// stopPusher waits for a delivery in progress to be aborted, so the consumer's offset is not confirmed after it returns.
+// pushMutex must be held.
+func (s *Server) stopPusher(consumerID string) {
+	p := s.pushers[consumerID]
+	if p == nil {
+		return
+	}
+	p.cancel()
+	<-p.done
+	delete(s.pushers, consumerID)
+}
+
+func (s *Server) hasWebhook(consumerID string) bool {
+	s.pushMutex.Lock()
+	defer s.pushMutex.Unlock()
+	return s.pushers[consumerID] != nil
+}
+
+// push delivers updates in order, confirming each one for the consumer once its webhook accepts it, the same as
+// asking getUpdates for a higher offset. An update is only confirmed after delivery, so a crash in between
+// delivers it again after the restart.
+func (s *Server) push(ctx context.Context, p *pusher) {
+	defer close(p.done)
+	var retryInterval time.Duration
+	for {
+		update, cancel := s.db.SubscribeNextUpdate()
+		updateJSON, err := s.nextPush(ctx, &p.hook)
+		if err == nil && len(updateJSON) != 0 {
+			cancel()
+			err = s.deliver(ctx, &p.hook, updateJSON)
+			if err == nil {
+				retryInterval = 0
+				_, err = s.db.AckOffset(ctx, p.hook.ConsumerID, gjson.Get(updateJSON, "update_id").Int()+1)
+				if err == nil {
+					continue
+				}
+			}
+		}
+		if ctx.Err() != nil {
+			cancel()
+			return
+		}
+		if err != nil {
+			cancel()
+			p.errorMutex.Lock()
+			p.lastErrorDate = time.Now().Unix()
+			p.lastErrorMessage = err.Error()
+			p.errorMutex.Unlock()
+			retryInterval = min(max(retryInterval*2, time.Second), pushMaxRetryInterval)
+			slog.Warn("Failed to deliver update to webhook, will retry", "consumer", p.hook.ConsumerID, "retry_after", retryInterval.String(), "err", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retryInterval):
+			}
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			cancel()
+			return
+		case <-update:
+		}
+	}
+}
+
+// nextPush returns the first update the consumer has not confirmed yet, or "" if there is none.
+func (s *Server) nextPush(ctx context.Context, hook *ConsumerWebhook) (string, error) {
+	offset, err := s.db.ConsumerOffset(ctx, hook.ConsumerID)
+	if err != nil {
+		return "", err
+	}
+	for updateJSON, err := range s.db.GetUpdates(ctx, hook.ConsumerID, max(offset, 1), 1, hook.AllowedUpdates) {
+		return updateJSON, err
+	}
+	return "", nil
+}
+
+func (s *Server) deliver(ctx context.Context, hook *ConsumerWebhook, updateJSON string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(s.conf.Downstream.WebhookTimeout)*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, strings.NewReader(updateJSON))
+	if err != nil {
+		return fmt.Errorf("failed to send HTTP request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", UserAgent)
+	if len(hook.SecretToken) != 0 {
+		req.Header.Set("X-Telegram-Bot-Api-Secret-Token", hook.SecretToken)
+	}
+	resp, err := s.pushClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook HTTP request error: %v", err)
+	}
+	defer drainAndClose(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("wrong response from the webhook: %s", resp.Status)
+	}
+	return nil
+}
+
+// setWebhook serves setWebhook and deleteWebhook for a consumer, instead of changing how we receive updates from upstream.
+// Like Telegram, allowed_updates keeps its previous value if left out, and a consumer with a webhook cannot call getUpdates.
+func (s *Server) setWebhook(w http.ResponseWriter, r *http.Request, method string) {
+	_ = r.ParseMultipartForm(10 << 20)
+	hook := ConsumerWebhook{
+		ConsumerID:  s.consumerID(r),
+		SecretToken: r.FormValue("secret_token"),
+	}
+	if method == "setWebhook" {
+		hook.URL = r.FormValue("url")
+	}
+	dropPending, _ := strconv.ParseBool(r.FormValue("drop_pending_updates"))
+	if len(hook.URL) != 0 {
+		u, err := url.Parse(hook.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			writeError(w, s.conf.Downstream.ErrorPrefix, http.StatusBadRequest, "Bad Request: bad webhook: an HTTP or HTTPS URL must be provided for webhook", 0)
+			return
+		}
+		if len(hook.SecretToken) > 256 || strings.ContainsFunc(hook.SecretToken, func(c rune) bool {
+			return !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-')
+		}) {
+			writeError(w, s.conf.Downstream.ErrorPrefix, http.StatusBadRequest, "Bad Request: secret token contains unallowed characters", 0)
+			return
+		}
+	}
+
+	s.pushMutex.Lock()
+	defer s.pushMutex.Unlock()
+	var err error
+	var description string
+	if len(hook.URL) == 0 {
+		description = "Webhook was deleted"
+		err = s.db.DeleteWebhook(r.Context(), hook.ConsumerID, dropPending)
+		if err == nil {
+			s.stopPusher(hook.ConsumerID)
+		}
+	} else {
+		description = "Webhook was set"
+		if r.Form.Has("allowed_updates") {
+			hook.AllowedUpdates = parseAllowedUpdates(r)
+		} else if p := s.pushers[hook.ConsumerID]; p != nil {
+			hook.AllowedUpdates = p.hook.AllowedUpdates
+		}
+		err = s.db.SetWebhook(r.Context(), &hook, dropPending)
+		if err == nil {
+			s.startPusher(hook)
+		}
+	}
+	if err != nil {
+		s.internalServerErrorHandler(w, err)
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	fmt.Fprintf(w, "{\"ok\":true,\"result\":true,\"description\":%s}", JSONQuote(description))
+}
+
+// getWebhookInfo reports the consumer's own webhook, set with setWebhook, rather than ours with upstream.
+func (s *Server) getWebhookInfo(w http.ResponseWriter, r *http.Request) {
+	consumerID := s.consumerID(r)
+	info := struct {
+		URL                  string   `json:"url"`
+		HasCustomCertificate bool     `json:"has_custom_certificate"`
+		PendingUpdateCount   uint64   `json:"pending_update_count"`
+		LastErrorDate        int64    `json:"last_error_date,omitempty"`
+		LastErrorMessage     string   `json:"last_error_message,omitempty"`
+		AllowedUpdates       []string `json:"allowed_updates,omitempty"`
+	}{}
+	s.pushMutex.Lock()
+	if p := s.pushers[consumerID]; p != nil {
+		info.URL = p.hook.URL
+		info.AllowedUpdates = p.hook.AllowedUpdates
+		p.errorMutex.Lock()
+		info.LastErrorDate = p.lastErrorDate
+		info.LastErrorMessage = p.lastErrorMessage
+		p.errorMutex.Unlock()
+	}
+	s.pushMutex.Unlock()
+	offset, err := s.db.ConsumerOffset(r.Context(), consumerID)
+	if err == nil {
+		info.PendingUpdateCount, err = s.db.CountUpdates(r.Context(), consumerID, max(offset, 1), info.AllowedUpdates)
+	}
+	if err != nil {
+		s.internalServerErrorHandler(w, err)
+		return
+	}
+	result, _ := json.Marshal(info)
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	fmt.Fprintf(w, "{\"ok\":true,\"result\":%s}", result)
+}
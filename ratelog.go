@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimitLog keeps the last 429 responses to forwarded requests in memory, to find which chats are being throttled.
+// It is a ring of fixed size, so a flood of them only pushes out older entries.
+type RateLimitLog struct {
+	mutex   *sync.Mutex
+	entries []RateLimitEntry
+	next    int
+	nextID  uint64
+}
+
+type RateLimitEntry struct {
+	ID         uint64 `json:"id"`
+	Date       int64  `json:"date"`
+	Method     string `json:"method"`
+	ChatID     string `json:"chat_id,omitempty"`
+	RetryAfter int64  `json:"retry_after"`
+}
+
+func NewRateLimitLog(size uint64) *RateLimitLog {
+	if size == 0 {
+		return nil
+	}
+	return &RateLimitLog{
+		mutex:   new(sync.Mutex),
+		entries: make([]RateLimitEntry, 0, size),
+		nextID:  1,
+	}
+}
+
+func (l *RateLimitLog) Add(method string, chatRef string, retryAfter time.Duration) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	entry := RateLimitEntry{
+		ID:         l.nextID,
+		Date:       time.Now().Unix(),
+		Method:     method,
+		ChatID:     chatRef,
+		RetryAfter: int64(retryAfter / time.Second),
+	}
+	l.nextID++
+	if len(l.entries) < cap(l.entries) {
+		l.entries = append(l.entries, entry)
+		return
+	}
+	l.entries[l.next] = entry
+	l.next = (l.next + 1) % len(l.entries)
+}
+
+// Entries returns the entries with an id of at least offset, oldest first.
+// Ids keep counting up across the ring, so a caller can pass the last id it saw plus one to get only newer ones.
+func (l *RateLimitLog) Entries(offset uint64) []RateLimitEntry {
+	entries := []RateLimitEntry{}
+	if l == nil {
+		return entries
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for i := range l.entries {
+		entry := l.entries[(l.next+i)%len(l.entries)]
+		if entry.ID >= offset {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
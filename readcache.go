@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// readCacheSweepSize is how many entries may pile up before expired ones are swept out.
+const readCacheSweepSize = 1024
+
+// ReadCacheMethods lists the methods upstream.read_cache accepts, whose result depends on chat_id alone.
+var ReadCacheMethods = []string{"getChat", "getChatAdministrators", "getChatMemberCount", "getMe"}
+
+// ReadCache serves repeated calls to read-only methods from memory for a configured TTL.
+// Entries are keyed by method and chat_id, which is why Load only accepts ReadCacheMethods.
+type ReadCache struct {
+	ttl     map[string]time.Duration
+	mutex   *sync.Mutex
+	entries map[string]readCacheEntry
+}
+
+type readCacheEntry struct {
+	body    []byte
+	expires time.Time
+}
+
+func NewReadCache(conf map[string]uint64) *ReadCache {
+	if len(conf) == 0 {
+		return nil
+	}
+	rc := &ReadCache{
+		ttl:     make(map[string]time.Duration, len(conf)),
+		mutex:   new(sync.Mutex),
+		entries: make(map[string]readCacheEntry),
+	}
+	for method, ttl := range conf {
+		rc.ttl[method] = time.Duration(ttl) * time.Second
+	}
+	return rc
+}
+
+func (rc *ReadCache) Cacheable(method string) bool {
+	if rc == nil {
+		return false
+	}
+	_, ok := rc.ttl[method]
+	return ok
+}
+
+func (rc *ReadCache) Get(method string, chatRef string) ([]byte, bool) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	entry, ok := rc.entries[method+"\x00"+chatRef]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.body, true
+}
+
+func (rc *ReadCache) Put(method string, chatRef string, body []byte) {
+	now := time.Now()
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	if len(rc.entries) >= readCacheSweepSize {
+		for k, v := range rc.entries {
+			if now.After(v.expires) {
+				delete(rc.entries, k)
+			}
+		}
+	}
+	rc.entries[method+"\x00"+chatRef] = readCacheEntry{
+		body:    body,
+		expires: now.Add(rc.ttl[method]),
+	}
+}
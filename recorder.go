@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Recorder saves forwarded requests and their upstream responses as JSON files, one exchange per file,
+// so a consumer's exact requests can be replayed later with -replay.
+// Credentials in headers are redacted, bodies are capped at MaxBodySize, and only the newest MaxFiles are kept.
+type Recorder struct {
+	conf  *ConfigRecording
+	mutex *sync.Mutex
+}
+
+type Recording struct {
+	Time                  time.Time   `json:"time"`
+	Method                string      `json:"method"`
+	HTTPMethod            string      `json:"http_method"`
+	Query                 string      `json:"query"`
+	RequestHeader         http.Header `json:"request_header"`
+	RequestBody           []byte      `json:"request_body"`
+	RequestBodyTruncated  bool        `json:"request_body_truncated"`
+	StatusCode            int         `json:"status_code"`
+	ResponseHeader        http.Header `json:"response_header"`
+	ResponseBody          []byte      `json:"response_body"`
+	ResponseBodyTruncated bool        `json:"response_body_truncated"`
+	requestBody           cappedBuffer
+	responseBody          cappedBuffer
+}
+
+// cappedBuffer keeps the first limit bytes written to it, and silently drops the rest.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	room := b.limit - b.buf.Len()
+	if len(p) > room {
+		b.buf.Write(p[:max(room, 0)])
+		b.truncated = true
+	} else {
+		b.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+func NewRecorder(conf *ConfigRecording) *Recorder {
+	if len(conf.Dir) == 0 {
+		return nil
+	}
+	return &Recorder{
+		conf:  conf,
+		mutex: new(sync.Mutex),
+	}
+}
+
+// Start returns nil if method should not be recorded.
+func (rec *Recorder) Start(r *http.Request, method string) *Recording {
+	if rec == nil || (len(rec.conf.Methods) != 0 && !slices.Contains(rec.conf.Methods, method)) {
+		return nil
+	}
+	return &Recording{
+		Time:          time.Now(),
+		Method:        method,
+		HTTPMethod:    r.Method,
+		Query:         r.URL.RawQuery,
+		RequestHeader: redactHeader(r.Header),
+		requestBody:   cappedBuffer{limit: int(rec.conf.MaxBodySize)},
+		responseBody:  cappedBuffer{limit: int(rec.conf.MaxBodySize)},
+	}
+}
+
+func (rec *Recorder) Save(recording *Recording, resp *http.Response) {
+	recording.RequestBody = recording.requestBody.buf.Bytes()
+	recording.RequestBodyTruncated = recording.requestBody.truncated
+	recording.StatusCode = resp.StatusCode
+	recording.ResponseHeader = redactHeader(resp.Header)
+	recording.ResponseBody = recording.responseBody.buf.Bytes()
+	recording.ResponseBodyTruncated = recording.responseBody.truncated
+
+	buf, err := json.MarshalIndent(recording, "", "  ")
+	if err != nil {
+		slog.Error("Failed to save recording", "method", recording.Method, "err", err)
+		return
+	}
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	err = os.MkdirAll(rec.conf.Dir, 0o700)
+	if err != nil {
+		slog.Error("Failed to save recording", "method", recording.Method, "err", err)
+		return
+	}
+	name := fmt.Sprintf("%d-%s.json", recording.Time.UnixNano(), recording.Method)
+	err = os.WriteFile(filepath.Join(rec.conf.Dir, name), buf, 0o600)
+	if err != nil {
+		slog.Error("Failed to save recording", "method", recording.Method, "err", err)
+		return
+	}
+
+	// Names start with a timestamp, so the oldest sort first
+	files, err := filepath.Glob(filepath.Join(rec.conf.Dir, "*.json"))
+	if err != nil || uint64(len(files)) <= rec.conf.MaxFiles {
+		return
+	}
+	slices.Sort(files)
+	for _, f := range files[:uint64(len(files))-rec.conf.MaxFiles] {
+		os.Remove(f)
+	}
+}
+
+func redactHeader(h http.Header) http.Header {
+	h = h.Clone()
+	for _, k := range []string{"Authorization", "Cookie", "Proxy-Authorization", "Set-Cookie"} {
+		if _, ok := h[k]; ok {
+			h[k] = []string{"<redacted>"}
+		}
+	}
+	return h
+}
+
+// Replay re-issues a recorded request against the configured upstream and prints the response.
+// Point the config at a test upstream first, a replayed send is a real send.
+func Replay(conf *Config, path string) error {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to load recording: %v", err)
+	}
+	var recording Recording
+	err = json.Unmarshal(buf, &recording)
+	if err != nil {
+		return fmt.Errorf("failed to load recording: %v", err)
+	}
+	if recording.RequestBodyTruncated {
+		return fmt.Errorf("failed to replay recording: request body was truncated when recorded")
+	}
+
+	requestURL := conf.Upstream.ApiURL(recording.Method, recording.Query)
+	slog.Debug("Replaying request", "http_method", recording.HTTPMethod, "url", requestURL)
+	req, err := http.NewRequest(recording.HTTPMethod, requestURL, bytes.NewReader(recording.RequestBody))
+	if err != nil {
+		return fmt.Errorf("failed to send HTTP request: %v", err)
+	}
+	for k, v := range recording.RequestHeader {
+		if !isHopByHopHeader(k) && k != "Accept-Encoding" && k != "Content-Encoding" && k != "Content-Length" && k != "Host" && k != "User-Agent" && !slices.Contains(v, "<redacted>") {
+			req.Header[k] = v
+		}
+	}
+	req.Header.Set("User-Agent", conf.Upstream.UserAgentHeader())
+	resp, err := newHTTPClient(&conf.Upstream).Do(req)
+	if err != nil {
+		return fmt.Errorf("upstream HTTP request error: %v", err)
+	}
+	defer drainAndClose(resp.Body)
+
+	fmt.Println(resp.Status)
+	if recording.StatusCode != resp.StatusCode {
+		fmt.Println("Recorded status was", recording.StatusCode)
+	}
+	_, err = io.Copy(os.Stdout, resp.Body)
+	fmt.Println()
+	if err != nil {
+		return fmt.Errorf("HTTP read error: %v", err)
+	}
+	return nil
+}
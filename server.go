@@ -1,50 +1,156 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
-	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/handlers"
+	"github.com/tidwall/gjson"
 )
 
 type Server struct {
-	conf       *Config
-	db         *Database
-	c          *Client
-	httpServer http.Server
-	listener   net.Listener
+	conf        *Config
+	db          *Database
+	c           *Client
+	httpServer  http.Server
+	listener    net.Listener
+	pollMutex   *sync.Mutex
+	activePolls map[string]uint64
+	closing     chan struct{}
+	certificate *atomic.Pointer[tls.Certificate]
+	bucketMutex *sync.Mutex
+	buckets     map[string]*tokenBucket
+	bucketSweep time.Time
+	pushMutex   *sync.Mutex
+	pushers     map[string]*pusher
+	pushCtx     context.Context
+	pushClient  *http.Client
+}
+
+// tokenBucket holds a consumer's allowance under downstream.rate_limit, as of updated.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
 }
 
 func NewServer(conf *Config, db *Database, c *Client) (*Server, error) {
 	s := &Server{
-		conf: conf,
-		db:   db,
-		c:    c,
+		conf:        conf,
+		db:          db,
+		c:           c,
+		pollMutex:   new(sync.Mutex),
+		activePolls: make(map[string]uint64),
+		closing:     make(chan struct{}),
+		certificate: new(atomic.Pointer[tls.Certificate]),
+		bucketMutex: new(sync.Mutex),
+		buckets:     make(map[string]*tokenBucket),
+		bucketSweep: time.Now(),
+		pushMutex:   new(sync.Mutex),
+		pushers:     make(map[string]*pusher),
+		// Redirects count as failed deliveries, like with Telegram
+		pushClient: &http.Client{
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+	// getUpdates decides on compression by itself, everything else goes through compressHandler
+	s.httpServer.Handler = handlers.CombinedLoggingHandler(os.Stdout, s)
+	// Consumers usually poll getUpdates in a tight loop, so keep their connections open between requests.
+	// A zero IdleTimeout falls back to ReadTimeout, which we leave unset, meaning no timeout.
+	s.httpServer.IdleTimeout = time.Duration(conf.Downstream.IdleTimeout) * time.Second
+	s.httpServer.ReadHeaderTimeout = time.Duration(conf.Downstream.ReadHeaderTimeout) * time.Second
+	s.httpServer.SetKeepAlivesEnabled(conf.Downstream.KeepAlive)
+	if len(conf.Downstream.TLSCert) != 0 {
+		err := s.ReloadCertificate()
+		if err != nil {
+			return nil, err
+		}
+		// Look the certificate up on every handshake, so a renewed one is picked up without restarting
+		s.httpServer.TLSConfig = &tls.Config{
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return s.certificate.Load(), nil
+			},
+		}
 	}
-	s.httpServer.Handler = handlers.CombinedLoggingHandler(os.Stdout, handlers.CompressHandler(s))
 	var err error
-	s.listener, err = net.Listen("tcp", conf.Downstream.ListenAddr)
+	if path, ok := strings.CutPrefix(conf.Downstream.ListenAddr, "unix:"); ok {
+		s.listener, err = listenUnix(path, os.FileMode(conf.Downstream.SocketMode))
+	} else {
+		s.listener, err = net.Listen("tcp", conf.Downstream.ListenAddr)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to start HTTP server: %v", err)
 	}
-	log.Println("HTTP server is listening on", s.listener.Addr())
+	slog.Info("HTTP server is listening", "addr", s.listener.Addr().String())
 	return s, nil
 }
 
+// listenUnix listens on a Unix socket, replacing one left behind by a previous run that did not shut down cleanly.
+// The listener removes the socket file again once closed.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode().Type() == os.ModeSocket {
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// Clients need write permission to connect, so this is what decides who may
+	err = os.Chmod(path, mode)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
 func (s *Server) Close() error {
 	return s.httpServer.Close()
 }
 
+// Shutdown ends pending long polls with an empty result, then waits for forwarded requests to finish.
+func (s *Server) Shutdown(ctx context.Context) error {
+	close(s.closing)
+	return s.httpServer.Shutdown(ctx)
+}
+
+// ReloadCertificate reads the TLS certificate and key again, if TLS is enabled.
+func (s *Server) ReloadCertificate() error {
+	if len(s.conf.Downstream.TLSCert) == 0 {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(s.conf.Downstream.TLSCert, s.conf.Downstream.TLSKey)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+	s.certificate.Store(&cert)
+	return nil
+}
+
 func (s *Server) Serve() error {
-	err := s.httpServer.Serve(s.listener)
+	var err error
+	if s.httpServer.TLSConfig != nil {
+		err = s.httpServer.ServeTLS(s.listener, "", "")
+	} else {
+		err = s.httpServer.Serve(s.listener)
+	}
 	if err == http.ErrServerClosed {
 		return nil
 	}
@@ -62,7 +168,7 @@ func (s *Server) matchApiUrl(r *http.Request) (string, int) {
 			if err != nil || !strings.HasPrefix(seg, s.conf.Downstream.ApiPrefix[i]) {
 				return "", http.StatusNotFound
 			}
-			if seg != s.conf.Downstream.ApiPrefix[i]+s.conf.Downstream.AuthToken {
+			if _, ok := s.tokenConsumer(seg, s.conf.Downstream.ApiPrefix[i]); !ok {
 				return "", http.StatusUnauthorized
 			}
 		} else {
@@ -89,7 +195,7 @@ func (s *Server) matchFileUrl(r *http.Request) (string, int) {
 			if err != nil || !strings.HasPrefix(seg, s.conf.Downstream.FilePrefix[i]) {
 				return "", http.StatusNotFound
 			}
-			if seg != s.conf.Downstream.FilePrefix[i]+s.conf.Downstream.AuthToken {
+			if _, ok := s.tokenConsumer(seg, s.conf.Downstream.FilePrefix[i]); !ok {
 				return "", http.StatusUnauthorized
 			}
 		} else {
@@ -106,17 +212,78 @@ func (s *Server) matchFileUrl(r *http.Request) (string, int) {
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.remoteAllowed(r) {
+		s.reportError(w, http.StatusForbidden)
+		return
+	}
+	if len(s.conf.Downstream.MetricsPath) != 0 && r.URL.Path == s.conf.Downstream.MetricsPath {
+		s.c.metrics.Handler().ServeHTTP(w, r)
+		return
+	}
+	if len(s.conf.Downstream.HealthPath) != 0 && r.URL.Path == s.conf.Downstream.HealthPath {
+		s.health(w, r)
+		return
+	}
 	method, code := s.matchApiUrl(r)
 	if code != http.StatusNotFound {
 		if code != http.StatusOK {
 			s.reportError(w, code)
 			return
 		}
+		if wait, ok := s.takeToken(s.consumerID(r)); !ok {
+			retryAfter := int64((wait + time.Second - 1) / time.Second)
+			writeError(w, s.conf.Downstream.ErrorPrefix, http.StatusTooManyRequests, fmt.Sprintf("Too Many Requests: retry after %d", retryAfter), retryAfter)
+			return
+		}
 		if method == "getUpdates" {
+			release, ok := s.acquirePoll(s.consumerID(r))
+			if !ok {
+				s.reportError(w, http.StatusTooManyRequests)
+				return
+			}
+			defer release()
 			s.getUpdates(w, r)
 			return
 		}
-		s.forwardAPI(w, r, method)
+		if method == "setWebhook" || method == "deleteWebhook" {
+			s.setWebhook(w, r, method)
+			return
+		}
+		if method == "getWebhookInfo" {
+			s.getWebhookInfo(w, r)
+			return
+		}
+		if method == "getMe" && s.c.config().Upstream.GetMeTTL != 0 {
+			s.getMe(w, r)
+			return
+		}
+		if method == "tbmuxReplayUpdates" {
+			s.replayUpdates(w, r)
+			return
+		}
+		if method == "tbmuxGetUpdateCount" {
+			s.getUpdateCount(w, r)
+			return
+		}
+		if method == "tbmuxSubscribeChat" || method == "tbmuxUnsubscribeChat" || method == "tbmuxGetSubscribedChats" {
+			s.manageSubscriptions(w, r, method)
+			return
+		}
+		if method == "tbmuxGetUpstreamErrors" {
+			s.getUpstreamErrors(w, r)
+			return
+		}
+		if method == "tbmuxGetRateLimits" {
+			s.getRateLimits(w, r)
+			return
+		}
+		if method == "tbmuxGetCachedMessage" {
+			s.getCachedMessage(w, r)
+			return
+		}
+		compressHandler(w, r, func(w http.ResponseWriter, r *http.Request) {
+			s.forwardAPI(w, r, method)
+		})
 		return
 	}
 	fileID, code := s.matchFileUrl(r)
@@ -125,50 +292,189 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			s.reportError(w, code)
 			return
 		}
-		s.forwardFile(w, r, fileID)
+		// Content-Range counts bytes of the file itself, so compressing a partial response would garble it
+		if len(r.Header.Get("Range")) != 0 {
+			s.forwardFile(w, r, fileID)
+			return
+		}
+		compressHandler(w, r, func(w http.ResponseWriter, r *http.Request) {
+			s.forwardFile(w, r, fileID)
+		})
 		return
 	}
 	s.reportError(w, code)
 }
 
+// remoteAllowed checks the client address against downstream.allowed_cidrs, which allow everyone if empty.
+// Behind a reverse proxy, the client is the proxy.
+func (s *Server) remoteAllowed(r *http.Request) bool {
+	if len(s.conf.Downstream.AllowedPrefixes) == 0 {
+		return true
+	}
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	// A dual-stack listener sees IPv4 clients as IPv4-mapped IPv6 addresses
+	addr := addrPort.Addr().Unmap()
+	for _, prefix := range s.conf.Downstream.AllowedPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func compressHandler(w http.ResponseWriter, r *http.Request, f http.HandlerFunc) {
+	handlers.CompressHandler(f).ServeHTTP(w, r)
+}
+
+// tokenConsumer checks the token in the last path segment before the method, and returns the consumer it names.
+// Consumers share downstream.auth_token, and tell themselves apart by using "<auth_token>_<consumer>" as their token.
+// A plain auth_token is the consumer named "default".
+func (s *Server) tokenConsumer(seg string, prefix string) (string, bool) {
+	suffix, ok := strings.CutPrefix(seg, prefix+s.conf.Downstream.AuthToken)
+	if !ok {
+		return "", false
+	}
+	if len(suffix) == 0 {
+		return "default", true
+	}
+	consumer, ok := strings.CutPrefix(suffix, "_")
+	if !ok || len(consumer) == 0 || len(consumer) > 64 {
+		return "", false
+	}
+	for _, c := range consumer {
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return "", false
+		}
+	}
+	return consumer, true
+}
+
+// consumerID identifies the downstream consumer of an API request already accepted by matchApiUrl.
+func (s *Server) consumerID(r *http.Request) string {
+	prefixSegCount := len(s.conf.Downstream.ApiPrefix)
+	path := strings.SplitN(r.URL.EscapedPath(), "/", prefixSegCount+1)
+	seg, _ := url.PathUnescape(path[prefixSegCount-1])
+	consumer, _ := s.tokenConsumer(seg, s.conf.Downstream.ApiPrefix[prefixSegCount-1])
+	return consumer
+}
+
+// takeToken counts an API call against the consumer's downstream.rate_limit, or returns how long to wait if over it.
+// It is separate from the upstream rate limit, and keeps one consumer calling in a tight loop from starving the others.
+func (s *Server) takeToken(consumer string) (time.Duration, bool) {
+	rate := s.conf.Downstream.RateLimit
+	if rate == 0 {
+		return 0, true
+	}
+	burst := float64(s.conf.Downstream.RateLimitBurst)
+	now := time.Now()
+	s.bucketMutex.Lock()
+	defer s.bucketMutex.Unlock()
+	// Full buckets are the same as missing ones, so drop them once in a while instead of keeping every consumer forever
+	if now.Sub(s.bucketSweep) > time.Minute {
+		for k, b := range s.buckets {
+			if b.tokens+now.Sub(b.updated).Seconds()*rate >= burst {
+				delete(s.buckets, k)
+			}
+		}
+		s.bucketSweep = now
+	}
+	b := s.buckets[consumer]
+	if b == nil {
+		b = &tokenBucket{tokens: burst, updated: now}
+		s.buckets[consumer] = b
+	}
+	b.tokens = min(b.tokens+now.Sub(b.updated).Seconds()*rate, burst)
+	b.updated = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// acquirePoll counts a long poll against the consumer's limit.
+// The returned function must be called once the poll ends, however it ends.
+func (s *Server) acquirePoll(consumer string) (func(), bool) {
+	s.pollMutex.Lock()
+	defer s.pollMutex.Unlock()
+	if s.conf.Downstream.MaxLongPolls != 0 && s.activePolls[consumer] >= s.conf.Downstream.MaxLongPolls {
+		return nil, false
+	}
+	s.activePolls[consumer]++
+	return func() {
+		s.pollMutex.Lock()
+		s.activePolls[consumer]--
+		if s.activePolls[consumer] == 0 {
+			delete(s.activePolls, consumer)
+		}
+		s.pollMutex.Unlock()
+	}, true
+}
+
 func (s *Server) getUpdates(w http.ResponseWriter, r *http.Request) {
 	// It seems the official API server ignores errors
 	_ = r.ParseMultipartForm(10 << 20)
 	offset, _ := strconv.ParseInt(r.FormValue("offset"), 10, 64)
 	limit, _ := strconv.ParseUint(r.FormValue("limit"), 10, 64)
 	timeout, _ := strconv.ParseUint(r.FormValue("timeout"), 10, 64)
+	// Not part of the Bot API, lets a consumer on a slow link ask for smaller batches than the configured cap
+	maxBytes, _ := strconv.ParseUint(r.FormValue("max_bytes"), 10, 64)
+	if maxBytes == 0 || (s.conf.Downstream.MaxResponseBytes != 0 && maxBytes > s.conf.Downstream.MaxResponseBytes) {
+		maxBytes = s.conf.Downstream.MaxResponseBytes
+	}
+	allowedUpdates := parseAllowedUpdates(r)
+	consumerID := s.consumerID(r)
+	if s.hasWebhook(consumerID) {
+		writeError(w, s.conf.Downstream.ErrorPrefix, http.StatusConflict, "Conflict: can't use getUpdates method while webhook is active; use deleteWebhook to delete the webhook first", 0)
+		return
+	}
 
-	if offset == 0 {
-		offset = -1
+	// Each consumer has its own cursor, advanced by asking for a higher offset, which is independent from
+	// the other consumers and from our own offset into upstream.
+	var err error
+	if offset > 0 {
+		offset, err = s.db.AckOffset(r.Context(), consumerID, offset)
+		if err != nil {
+			s.internalServerErrorHandler(w, err)
+			return
+		}
+	}
+	offset, err = s.readOffset(r.Context(), consumerID, offset)
+	if err != nil {
+		s.internalServerErrorHandler(w, err)
+		return
 	}
 	if limit == 0 || limit > 100 {
 		limit = 100
 	}
+	// getUpdates has no way to send keepalive bytes while waiting, so stay below the idle timeout of proxies in front of us
+	if s.conf.Downstream.MaxPollTimeout != 0 {
+		timeout = min(timeout, s.conf.Downstream.MaxPollTimeout)
+	}
 	timer := time.After(time.Duration(timeout) * time.Second)
 
 	for {
 		update, cancel := s.db.SubscribeNextUpdate()
-		updatesReceived := false
-		for updateJSON, err := range s.db.GetUpdates(r.Context(), offset, limit) {
-			if err != nil {
-				cancel()
-				s.internalServerErrorHandler(w, err)
-				return
-			}
-			if !updatesReceived {
-				h := w.Header()
-				h.Set("Content-Type", "application/json")
-				h.Set("X-Content-Type-Options", "nosniff")
-				w.Write([]byte("{\"ok\":true,\"result\":["))
-			} else {
-				w.Write([]byte{','})
-			}
-			updatesReceived = true
-			fmt.Fprint(w, updateJSON)
+		updates, err := s.collectUpdates(r.Context(), consumerID, offset, limit, maxBytes, allowedUpdates)
+		if err != nil {
+			cancel()
+			s.internalServerErrorHandler(w, err)
+			return
 		}
-		if updatesReceived {
+		if len(updates) != 0 {
 			cancel()
-			w.Write([]byte("]}"))
+			// Like Telegram, a negative offset forgets every update before the ones it returns
+			if offset < 0 {
+				_, err := s.db.AckOffset(r.Context(), consumerID, gjson.Get(updates[0], "update_id").Int())
+				if err != nil {
+					s.internalServerErrorHandler(w, err)
+					return
+				}
+			}
+			s.writeUpdates(w, r, updates)
 			return
 		}
 
@@ -180,38 +486,352 @@ func (s *Server) getUpdates(w http.ResponseWriter, r *http.Request) {
 			h.Set("X-Content-Type-Options", "nosniff")
 			w.Write([]byte("{\"ok\":true,\"result\":[]}"))
 			return
+		case <-s.closing:
+			cancel()
+			h := w.Header()
+			h.Set("Content-Type", "application/json")
+			h.Set("X-Content-Type-Options", "nosniff")
+			w.Write([]byte("{\"ok\":true,\"result\":[]}"))
+			return
+		case <-r.Context().Done():
+			// The consumer went away, so free its max_long_polls slot now instead of when the timeout runs out
+			cancel()
+			return
 		case <-update:
 		}
+		// Give a busy bot a moment to produce more updates, so we return them in one batch instead of one query each
+		if s.conf.Downstream.CoalesceWindowMs != 0 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-s.closing:
+				// Hand over what arrived so far right away, rather than hold up shutdown for the rest of the window
+			case <-time.After(time.Duration(s.conf.Downstream.CoalesceWindowMs) * time.Millisecond):
+			}
+		}
 	}
 }
 
+// readOffset turns the offset a consumer asked for into the one getUpdates reads from.
+// getUpdates acknowledges a positive offset first, getUpdateCount doesn't, which comes out the same here.
+func (s *Server) readOffset(ctx context.Context, consumerID string, offset int64) (int64, error) {
+	if s.conf.Downstream.RequireAck || offset == 0 {
+		acked, err := s.db.ConsumerOffset(ctx, consumerID)
+		if err != nil {
+			return 0, err
+		}
+		if s.conf.Downstream.RequireAck {
+			// Serve from the last acknowledged offset no matter what was asked for, so a consumer keeps getting
+			// the same batch until it confirms it with a higher offset, just like Telegram's own getUpdates.
+			// A consumer that never confirms just sees its backlog grow until retention prunes it.
+			offset = max(acked, offset, 1)
+		} else {
+			// Like Telegram, offset=0 resumes after the last confirmed update, which is nothing for a new consumer
+			offset = acked
+		}
+	}
+	if offset == 0 {
+		offset = -1
+	}
+	return offset, nil
+}
+
+// collectUpdates reads a whole batch before anything is written, so a database error halfway never leaves a truncated array.
+// Updates left out by maxBytes come first in the next batch, since the consumer's next offset only skips what it got.
+// The first update is always included, otherwise a single oversized one would block the consumer forever.
+func (s *Server) collectUpdates(ctx context.Context, consumerID string, offset int64, limit uint64, maxBytes uint64, allowedUpdates []string) ([]string, error) {
+	var updates []string
+	var size uint64
+	for updateJSON, err := range s.db.GetUpdates(ctx, consumerID, offset, limit, allowedUpdates) {
+		if err != nil {
+			return nil, err
+		}
+		size += uint64(len(updateJSON)) + 1
+		if maxBytes != 0 && len(updates) != 0 && size > maxBytes {
+			break
+		}
+		updates = append(updates, updateJSON)
+	}
+	return updates, nil
+}
+
+func (s *Server) writeUpdates(w http.ResponseWriter, r *http.Request, updates []string) {
+	var body bytes.Buffer
+	body.WriteString("{\"ok\":true,\"result\":[")
+	for i, updateJSON := range updates {
+		if i != 0 {
+			body.WriteByte(',')
+		}
+		body.WriteString(updateJSON)
+	}
+	body.WriteString("]}")
+
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Add("Vary", "Accept-Encoding")
+	// Compressing a handful of updates costs more than it saves, only do it for catch-up reads
+	if s.conf.Downstream.CompressThreshold != 0 && uint64(body.Len()) >= s.conf.Downstream.CompressThreshold && acceptsGzip(r) {
+		h.Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		body.WriteTo(gz)
+		gz.Close()
+		return
+	}
+	h.Set("Content-Length", strconv.Itoa(body.Len()))
+	body.WriteTo(w)
+}
+
+// replayUpdates is a muxer-specific method returning the stored updates from offset on, such as for a consumer
+// that lost its state and needs to see updates it already confirmed again. It never waits for new updates and
+// never moves the consumer's cursor, so it works the same with downstream.require_ack, and getUpdates carries on
+// where it was afterwards. Updates already pruned by retention are gone for good.
+func (s *Server) replayUpdates(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseMultipartForm(10 << 20)
+	offset, _ := strconv.ParseInt(r.FormValue("offset"), 10, 64)
+	if offset <= 0 {
+		writeError(w, s.conf.Downstream.ErrorPrefix, http.StatusBadRequest, "Bad Request: offset must be the positive update_id to replay from", 0)
+		return
+	}
+	limit, _ := strconv.ParseUint(r.FormValue("limit"), 10, 64)
+	if limit == 0 || limit > 100 {
+		limit = 100
+	}
+	maxBytes, _ := strconv.ParseUint(r.FormValue("max_bytes"), 10, 64)
+	if maxBytes == 0 || (s.conf.Downstream.MaxResponseBytes != 0 && maxBytes > s.conf.Downstream.MaxResponseBytes) {
+		maxBytes = s.conf.Downstream.MaxResponseBytes
+	}
+	updates, err := s.collectUpdates(r.Context(), s.consumerID(r), offset, limit, maxBytes, parseAllowedUpdates(r))
+	if err != nil {
+		s.internalServerErrorHandler(w, err)
+		return
+	}
+	s.writeUpdates(w, r, updates)
+}
+
+// parseAllowedUpdates reads the allowed_updates parameter of getUpdates, a JSON array of update types.
+// Unlike Telegram, it only applies to the request carrying it, since each consumer shares our one upstream filter.
+// Updates left out are skipped for good once the consumer confirms a later one, like with Telegram.
+func parseAllowedUpdates(r *http.Request) []string {
+	var updateTypes []string
+	for _, t := range gjson.Parse(r.FormValue("allowed_updates")).Array() {
+		if t.Type == gjson.String {
+			updateTypes = append(updateTypes, t.String())
+		}
+	}
+	return updateTypes
+}
+
+// health answers load balancers with 200 while polling keeps succeeding, and with 503 once it has not for
+// downstream.health_stale_after seconds, such as while upstream is down and we are backing off.
+func (s *Server) health(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Cache-Control", "no-store")
+	since, ok := s.c.SinceLastPoll()
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("{\"ok\":false,\"description\":\"no successful poll yet\"}"))
+		return
+	}
+	seconds := uint64(since / time.Second)
+	if seconds >= s.conf.Downstream.HealthStaleAfter {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "{\"ok\":false,\"description\":\"no successful poll for %d seconds\",\"seconds_since_last_poll\":%d}", seconds, seconds)
+		return
+	}
+	fmt.Fprintf(w, "{\"ok\":true,\"seconds_since_last_poll\":%d}", seconds)
+}
+
+// getUpdateCount is a muxer-specific method returning how many updates getUpdates has available, without their bodies.
+func (s *Server) getUpdateCount(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseMultipartForm(10 << 20)
+	offset, _ := strconv.ParseInt(r.FormValue("offset"), 10, 64)
+	consumerID := s.consumerID(r)
+	offset, err := s.readOffset(r.Context(), consumerID, offset)
+	if err != nil {
+		s.internalServerErrorHandler(w, err)
+		return
+	}
+	count, err := s.db.CountUpdates(r.Context(), consumerID, offset, parseAllowedUpdates(r))
+	if err != nil {
+		s.internalServerErrorHandler(w, err)
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	fmt.Fprintf(w, "{\"ok\":true,\"result\":%d}", count)
+}
+
+// manageSubscriptions serves the muxer-specific methods limiting getUpdates to chosen chats.
+// tbmuxSubscribeChat and tbmuxUnsubscribeChat take a numeric chat_id, and all three return the resulting list.
+// Subscriptions are stored in the database, so they survive restarts, and an empty list means every chat.
+func (s *Server) manageSubscriptions(w http.ResponseWriter, r *http.Request, method string) {
+	_ = r.ParseMultipartForm(10 << 20)
+	consumerID := s.consumerID(r)
+	if method != "tbmuxGetSubscribedChats" {
+		chatID, err := strconv.ParseInt(r.FormValue("chat_id"), 10, 64)
+		if err != nil || chatID == 0 {
+			writeError(w, s.conf.Downstream.ErrorPrefix, http.StatusBadRequest, "Bad Request: chat_id must be a numeric chat ID", 0)
+			return
+		}
+		if method == "tbmuxSubscribeChat" {
+			err = s.db.Subscribe(r.Context(), consumerID, chatID)
+		} else {
+			err = s.db.Unsubscribe(r.Context(), consumerID, chatID)
+		}
+		if err != nil {
+			s.internalServerErrorHandler(w, err)
+			return
+		}
+		// A waiting getUpdates may now have something to return
+		s.db.NotifyUpdates()
+	}
+	chatIDs, err := s.db.Subscriptions(r.Context(), consumerID)
+	if err != nil {
+		s.internalServerErrorHandler(w, err)
+		return
+	}
+	result, _ := json.Marshal(chatIDs)
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	fmt.Fprintf(w, "{\"ok\":true,\"result\":%s}", result)
+}
+
+// getUpstreamErrors is a muxer-specific method returning the errors recorded by upstream.log_errors.
+// offset and limit work the same as in getUpdates, with the id of each error in place of update_id.
+func (s *Server) getUpstreamErrors(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseMultipartForm(10 << 20)
+	offset, _ := strconv.ParseInt(r.FormValue("offset"), 10, 64)
+	limit, _ := strconv.ParseUint(r.FormValue("limit"), 10, 64)
+	if limit == 0 || limit > 100 {
+		limit = 100
+	}
+	if offset == 0 {
+		offset = -int64(limit)
+	}
+	upstreamErrors, err := s.db.GetUpstreamErrors(r.Context(), offset, limit)
+	if err != nil {
+		s.internalServerErrorHandler(w, err)
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	fmt.Fprintf(w, "{\"ok\":true,\"result\":[%s]}", strings.Join(upstreamErrors, ","))
+}
+
+// getRateLimits is a muxer-specific method returning the 429 responses kept by upstream.rate_limit_log, oldest first.
+// offset skips entries with a lower id, like in getUpdates.
+func (s *Server) getRateLimits(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseMultipartForm(10 << 20)
+	offset, _ := strconv.ParseUint(r.FormValue("offset"), 10, 64)
+	result, _ := json.Marshal(s.c.rateLimitLog.Entries(offset))
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	fmt.Fprintf(w, "{\"ok\":true,\"result\":%s}", result)
+}
+
+// getCachedMessage is a muxer-specific method returning a message from our cache instead of asking upstream.
+// It takes a numeric chat_id and message_id, plus business_connection_id for messages of business chats.
+// Messages never seen, pruned by retention, or deleted through us are all answered with 404.
+// Inline messages are never returned to us, so for an inline_message_id it returns the last edit made through us instead,
+// with the method, edit_date, and reply_markup it set.
+func (s *Server) getCachedMessage(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseMultipartForm(10 << 20)
+	if inlineMessageID := r.FormValue("inline_message_id"); len(inlineMessageID) != 0 {
+		edit, err := s.db.GetInlineEdit(r.Context(), inlineMessageID)
+		if err != nil {
+			s.internalServerErrorHandler(w, err)
+			return
+		}
+		if len(edit) == 0 {
+			writeError(w, s.conf.Downstream.ErrorPrefix, http.StatusNotFound, "Not Found: message is not cached", 0)
+			return
+		}
+		h := w.Header()
+		h.Set("Content-Type", "application/json")
+		h.Set("X-Content-Type-Options", "nosniff")
+		fmt.Fprintf(w, "{\"ok\":true,\"result\":%s}", edit)
+		return
+	}
+	chatID, err := strconv.ParseInt(r.FormValue("chat_id"), 10, 64)
+	if err != nil || chatID == 0 {
+		writeError(w, s.conf.Downstream.ErrorPrefix, http.StatusBadRequest, "Bad Request: chat_id must be a numeric chat ID", 0)
+		return
+	}
+	messageID, err := strconv.ParseInt(r.FormValue("message_id"), 10, 64)
+	if err != nil || messageID == 0 {
+		writeError(w, s.conf.Downstream.ErrorPrefix, http.StatusBadRequest, "Bad Request: message_id must be a number", 0)
+		return
+	}
+	var businessConnectionID sql.NullString
+	if r.Form.Has("business_connection_id") {
+		businessConnectionID = sql.NullString{String: r.FormValue("business_connection_id"), Valid: true}
+	}
+	message, receivedAt, deleted, err := s.db.GetMessage(r.Context(), chatID, messageID, businessConnectionID)
+	if err != nil {
+		s.internalServerErrorHandler(w, err)
+		return
+	}
+	if len(message) == 0 {
+		writeError(w, s.conf.Downstream.ErrorPrefix, http.StatusNotFound, "Not Found: message is not cached", 0)
+		return
+	}
+	if deleted {
+		writeError(w, s.conf.Downstream.ErrorPrefix, http.StatusNotFound, "Not Found: message was deleted", 0)
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	// Next to result rather than inside it, so the message stays as upstream sent it
+	fmt.Fprintf(w, "{\"ok\":true,\"result\":%s,\"received_at\":%d}", message, receivedAt)
+}
+
+// getMe answers from the cached result, falling back to forwarding the call if upstream could not be asked,
+// so the consumer sees upstream's own error, such as for a revoked token.
+func (s *Server) getMe(w http.ResponseWriter, r *http.Request) {
+	result, err := s.c.GetMe(r.Context())
+	if err != nil {
+		slog.Warn("Failed to fetch getMe for caching", "err", err)
+		compressHandler(w, r, func(w http.ResponseWriter, r *http.Request) {
+			s.forwardAPI(w, r, "getMe")
+		})
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	fmt.Fprintf(w, "{\"ok\":true,\"result\":%s}", result)
+}
+
 func (s *Server) forwardAPI(w http.ResponseWriter, r *http.Request, method string) {
-	err := s.c.ForwardRequest(r.Context(), w, r, s.conf.Upstream.ApiPrefix, method, false)
+	err := s.c.ForwardRequest(r.Context(), w, r, method, false)
 	if err != nil {
-		log.Println("API forward error:", err)
+		slog.Warn("API forward error", "method", method, "err", err)
 		s.reportError(w, http.StatusBadGateway)
 	}
 }
 
 func (s *Server) forwardFile(w http.ResponseWriter, r *http.Request, fileID string) {
-	err := s.c.ForwardRequest(r.Context(), w, r, s.conf.Upstream.FilePrefix, fileID, true)
+	err := s.c.ForwardRequest(r.Context(), w, r, fileID, true)
 	if err != nil {
-		log.Println("File forward error:", err)
+		slog.Warn("File forward error", "err", err)
 		s.reportError(w, http.StatusBadGateway)
 	}
 }
 
 func (s *Server) reportError(w http.ResponseWriter, code int) {
-	h := w.Header()
-	h.Del("Content-Length")
-	h.Set("Content-Type", "application/json")
-	h.Set("X-Content-Type-Options", "nosniff")
-	w.WriteHeader(code)
-	fmt.Fprintf(w, "{\"ok\":false,\"error_code\":%d,\"description\":%s}", code, http.StatusText(code))
+	writeError(w, s.conf.Downstream.ErrorPrefix, code, http.StatusText(code), 0)
 }
 
 func (s *Server) internalServerErrorHandler(w http.ResponseWriter, err error) {
-	log.Println("Error:", err)
-	debug.PrintStack()
+	slog.Error("Internal server error", "err", err)
+	printStackIfDebug(context.Background())
 	s.reportError(w, http.StatusInternalServerError)
 }
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestKeepAlive(t *testing.T) {
+	// Upstream closing its connections must not close the consumer's
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close")
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"ok":true,"result":{"id":5,"type":"private"}}`)
+	}))
+	defer upstream.Close()
+
+	for _, keepAlive := range []bool{true, false} {
+		t.Run(fmt.Sprintf("keep_alive=%v", keepAlive), func(t *testing.T) {
+			conf := testConfig(t, upstream.URL, fmt.Sprintf("downstream.keep_alive = %v", keepAlive))
+			_, apiURL := testServer(t, conf)
+			client := &http.Client{Transport: &http.Transport{}}
+			defer client.CloseIdleConnections()
+
+			var reused []bool
+			trace := &httptrace.ClientTrace{
+				GotConn: func(info httptrace.GotConnInfo) {
+					reused = append(reused, info.Reused)
+				},
+			}
+			for range 3 {
+				req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, apiURL+"getChat?chat_id=5", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp, err := client.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("getChat returned %s", resp.Status)
+				}
+			}
+			want := []bool{false, keepAlive, keepAlive}
+			if !slices.Equal(reused, want) {
+				t.Errorf("connections reused = %v, want %v", reused, want)
+			}
+		})
+	}
+}
+
+// getBody calls url and returns the response status and body.
+func getBody(t *testing.T, url string) (int, []byte) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, body
+}
+
+func TestGetUpdatesReadError(t *testing.T) {
+	conf := testConfig(t, "")
+	s, apiURL := testServer(t, conf)
+	ctx := context.Background()
+	tx, err := s.db.BeginTx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 3 {
+		err = tx.InsertLocalUpdate("message", testMessage(i+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Update 2 no longer decompresses, so reading fails after update 1 was already read
+	_, err = s.db.conn.Exec("UPDATE updates SET compression = ?, \"update\" = x'00' WHERE id = 2;", dbCompressionGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, body := getBody(t, apiURL+"getUpdates?offset=1&limit=1")
+	if status != http.StatusOK || !json.Valid(body) || gjson.GetBytes(body, "result.#").Int() != 1 {
+		t.Fatalf("getUpdates before the broken update returned %d %s", status, body)
+	}
+
+	tests := []struct {
+		name       string
+		url        string
+		consumerID string
+		wantOffset int64
+	}{
+		// Confirms update 1, which the consumer got above, but nothing past it
+		{"offset", apiURL + "getUpdates?offset=2", "default", 2},
+		// Would forget everything before update 2, but the consumer never got it
+		{"negative offset", apiURL[:len(apiURL)-1] + "_other/getUpdates?offset=-2", "other", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := getBody(t, tt.url)
+			if status != http.StatusInternalServerError {
+				t.Errorf("getUpdates returned %d, want %d", status, http.StatusInternalServerError)
+			}
+			if !json.Valid(body) || gjson.GetBytes(body, "ok").Type != gjson.False {
+				t.Errorf("getUpdates returned malformed error %q", body)
+			}
+			offset, err := s.db.ConsumerOffset(ctx, tt.consumerID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if offset != tt.wantOffset {
+				t.Errorf("consumer offset = %d, want %d", offset, tt.wantOffset)
+			}
+		})
+	}
+}
+
+func TestGetUpdateCount(t *testing.T) {
+	for _, requireAck := range []bool{false, true} {
+		t.Run(fmt.Sprintf("require_ack=%v", requireAck), func(t *testing.T) {
+			conf := testConfig(t, "", fmt.Sprintf("downstream.require_ack = %v", requireAck))
+			s, apiURL := testServer(t, conf)
+			tx, err := s.db.BeginTx()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range 5 {
+				err = tx.InsertLocalUpdate("message", testMessage(i+1))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = tx.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Confirms updates 1 and 2
+			status, body := getBody(t, apiURL+"getUpdates?offset=3")
+			if status != http.StatusOK {
+				t.Fatalf("getUpdates returned %d %s", status, body)
+			}
+
+			for _, offset := range []string{"", "0", "3"} {
+				status, body := getBody(t, apiURL+"tbmuxGetUpdateCount?offset="+offset)
+				if status != http.StatusOK {
+					t.Fatalf("tbmuxGetUpdateCount returned %d %s", status, body)
+				}
+				if count := gjson.GetBytes(body, "result").Int(); count != 3 {
+					t.Errorf("tbmuxGetUpdateCount with offset %q returned %d, want 3", offset, count)
+				}
+				_, body = getBody(t, apiURL+"getUpdates?limit=100&offset="+offset)
+				if count := gjson.GetBytes(body, "result.#").Int(); count != 3 {
+					t.Errorf("getUpdates with offset %q returned %d updates, want 3", offset, count)
+				}
+			}
+		})
+	}
+}
+
+func TestShutdownDuringCoalesceWindow(t *testing.T) {
+	conf := testConfig(t, "", "downstream.coalesce_window_ms = 30000")
+	s, apiURL := testServer(t, conf)
+	responses := make(chan *http.Response, 1)
+	go func() {
+		// Not getBody, which must not call t.Fatal outside the test goroutine
+		resp, err := http.Get(apiURL + "getUpdates?timeout=60")
+		if err != nil {
+			t.Error(err)
+		}
+		responses <- resp
+	}()
+	// Let the poll start waiting, then wake it up with an update, which starts the coalesce window
+	time.Sleep(200 * time.Millisecond)
+	tx, err := s.db.BeginTx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.InsertLocalUpdate("message", testMessage(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.db.NotifyUpdates()
+	time.Sleep(200 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = s.Shutdown(ctx)
+	if err != nil {
+		t.Fatalf("Shutdown returned %v, the poll held it for the coalesce window", err)
+	}
+	resp := <-responses
+	if resp == nil {
+		return
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || gjson.GetBytes(body, "result.#").Int() != 1 {
+		t.Errorf("getUpdates returned %d %s, want the update", resp.StatusCode, body)
+	}
+}
@@ -1,6 +1,37 @@
 package main
 
-import "encoding/json"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// NewLogHandler returns the slog handler selected by downstream.log_format and downstream.log_level.
+// Output of the log package goes through it as well, at info level, once it is set as the default.
+func NewLogHandler(conf *ConfigDownstream) slog.Handler {
+	opts := &slog.HandlerOptions{Level: conf.LogLevelValue}
+	if conf.LogFormat == "json" {
+		return slog.NewJSONHandler(os.Stderr, opts)
+	}
+	return slog.NewTextHandler(os.Stderr, opts)
+}
+
+// printStackIfDebug prints the stack trace leading to an error, which is only useful while debugging.
+func printStackIfDebug(ctx context.Context) {
+	if slog.Default().Enabled(ctx, slog.LevelDebug) {
+		debug.PrintStack()
+	}
+}
 
 func JSONQuote(s string) string {
 	buf, err := json.Marshal(s)
@@ -9,3 +40,67 @@ func JSONQuote(s string) string {
 	}
 	return string(buf)
 }
+
+func isHopByHopHeader(key string) bool {
+	switch key {
+	case "Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade":
+		return true
+	}
+	return false
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(encoding, ";")
+		name = strings.TrimSpace(name)
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		q, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q=")
+		return !ok || strings.Trim(q, "0.") != ""
+	}
+	return false
+}
+
+// writeError answers with an error generated by tbmux itself, in the format Bot API libraries expect.
+// prefix is downstream.error_prefix, telling consumers the error did not come from Telegram.
+// retryAfter is only included if nonzero.
+func writeError(w http.ResponseWriter, prefix string, code int, description string, retryAfter int64) {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Del("Content-Encoding")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	if retryAfter != 0 {
+		h.Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	}
+	w.WriteHeader(code)
+	if retryAfter != 0 {
+		fmt.Fprintf(w, "{\"ok\":false,\"error_code\":%d,\"description\":%s,\"parameters\":{\"retry_after\":%d}}", code, JSONQuote(prefix+description), retryAfter)
+	} else {
+		fmt.Fprintf(w, "{\"ok\":false,\"error_code\":%d,\"description\":%s}", code, JSONQuote(prefix+description))
+	}
+}
+
+// maxDrainSize is how much of an unread upstream body we discard to keep its connection reusable.
+// Anything longer, like an aborted file download, is cheaper to close than to read.
+const maxDrainSize = 64 << 10
+
+// drainAndClose closes an upstream response body. Go only reuses a keep-alive connection
+// once its body has been read to the end, so read off whatever is left first, up to maxDrainSize.
+func drainAndClose(body io.ReadCloser) {
+	io.CopyN(io.Discard, body, maxDrainSize)
+	body.Close()
+}
+
+// retryAfter reads how long upstream asked us to wait, from parameters.retry_after or else the Retry-After header.
+func retryAfter(header http.Header, body []byte) time.Duration {
+	if seconds := gjson.GetBytes(body, "parameters.retry_after"); seconds.Type == gjson.Number {
+		return time.Duration(seconds.Int()) * time.Second
+	}
+	seconds, err := strconv.ParseUint(header.Get("Retry-After"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// StartWebhook receives updates from upstream by webhook instead of polling, until ctx is done.
+// The webhook is deleted again on exit, so upstream keeps any updates arriving while we are down.
+func (c *Client) StartWebhook(ctx context.Context) error {
+	conf := &c.config().Upstream.Webhook
+	listener, err := net.Listen("tcp", conf.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to start webhook server: %v", err)
+	}
+	slog.Info("Webhook server is listening", "addr", listener.Addr().String())
+	server := &http.Server{
+		Handler:           http.HandlerFunc(c.receiveWebhook),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	serveDone := make(chan error, 1)
+	go func() {
+		serveDone <- server.Serve(listener)
+	}()
+
+	query := "url=" + url.QueryEscape(conf.URL) + "&allowed_updates=" + c.config().Upstream.FilterUpdateTypesStr
+	if len(conf.SecretToken) != 0 {
+		query += "&secret_token=" + url.QueryEscape(conf.SecretToken)
+	}
+	for {
+		_, err = c.callMethod(ctx, "setWebhook", query)
+		if err == nil {
+			c.resetRetry()
+			c.lastPoll.Store(time.Now().UnixNano())
+			break
+		}
+		slog.Warn("Failed to set webhook", "err", err)
+		c.sleepUntilRetry(ctx)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	select {
+	case err = <-serveDone:
+		return fmt.Errorf("webhook server error: %v", err)
+	case <-ctx.Done():
+	}
+
+	// Delete the webhook before closing the server, so upstream stops delivering before we stop accepting
+	deleteCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = c.callMethod(deleteCtx, "deleteWebhook", "")
+	if err != nil {
+		slog.Warn("Failed to delete webhook", "err", err)
+	}
+	return server.Shutdown(deleteCtx)
+}
+
+func (c *Client) receiveWebhook(w http.ResponseWriter, r *http.Request) {
+	conf := &c.config().Upstream.Webhook
+	if r.URL.Path != conf.Path {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if len(conf.SecretToken) != 0 && subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Telegram-Bot-Api-Secret-Token")), []byte(conf.SecretToken)) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if conf.MaxBodySize != 0 {
+		// The listener faces the internet, so don't let anyone make us buffer an endless body
+		r.Body = http.MaxBytesReader(w, r.Body, int64(conf.MaxBodySize))
+	}
+	body, err := io.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		slog.Warn("Webhook request body too large", "limit", tooLarge.Limit)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		slog.Warn("HTTP read error", "err", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !gjson.ValidBytes(body) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	update := gjson.ParseBytes(body)
+
+	// Answering with an error makes upstream deliver the update again later, and storing it twice is skipped
+	tx, err := c.db.BeginTx()
+	if err != nil {
+		slog.Error("Failed to store updates", "update_id", update.Get("update_id").Uint(), "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	err = c.storeUpdate(&tx, &update)
+	if err != nil {
+		tx.Commit()
+		c.db.NotifyUpdates()
+		slog.Error("Failed to store updates", "update_id", update.Get("update_id").Uint(), "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	err = tx.Commit()
+	c.db.NotifyUpdates()
+	if err != nil {
+		slog.Error("Failed to store updates", "update_id", update.Get("update_id").Uint(), "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// callMethod calls an API method upstream on our own behalf, rather than a consumer's, and returns its result.
+func (c *Client) callMethod(ctx context.Context, method string, query string) (gjson.Result, error) {
+	requestURL := c.config().Upstream.ApiURL(method, query)
+	slog.Debug("Calling upstream", "method", method, "url", requestURL)
+	ctx, cancel := c.requestContext(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return gjson.Result{}, fmt.Errorf("failed to send HTTP request: %v", err)
+	}
+	req.Header.Set("User-Agent", c.config().Upstream.UserAgentHeader())
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return gjson.Result{}, fmt.Errorf("upstream HTTP request error: %v", err)
+	}
+	defer drainAndClose(resp.Body)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return gjson.Result{}, fmt.Errorf("HTTP read error: %v", err)
+	}
+	bodyJson := gjson.ParseBytes(body)
+	if bodyJson.Get("ok").Type != gjson.True {
+		return gjson.Result{}, fmt.Errorf("upstream error: %s %s", bodyJson.Get("error_code").String(), bodyJson.Get("description").String())
+	}
+	return bodyJson.Get("result"), nil
+}